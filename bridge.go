@@ -0,0 +1,76 @@
+package qcat
+
+import (
+	"fmt"
+
+	"github.com/ghetzel/go-stockutil/utils"
+)
+
+// Move messages from this client's queue to another client (which may be connected to a different
+// broker), until an error occurs or the subscription ends.  If given, transform is called with
+// each message and returns the message to publish in its place; returning a nil message skips it,
+// and returning an error rejects it (dead-lettering it, if the source queue is configured to).
+//
+// Each source message is only acknowledged once it has been published to the destination (and
+// confirmed, if the destination has Confirms enabled), so AutoAck must be disabled.  If publishing
+// fails, the source message is requeued and Bridge returns the error.
+func (self *AMQP) Bridge(dst *AMQP, transform func(*Message) (*Message, error)) error {
+	if dst == nil {
+		return fmt.Errorf("no destination given")
+	} else if self.AutoAck {
+		return fmt.Errorf("bridging requires AutoAck to be disabled on the source")
+	}
+
+	cancel, err := self.Subscribe()
+
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case message, ok := <-self.Receive():
+			if !ok {
+				return cancel()
+			}
+
+			if err := self.bridge(dst, message, transform); err != nil {
+				return utils.AppendError(err, cancel())
+			}
+		case err := <-self.Err():
+			return utils.AppendError(err, cancel())
+		}
+	}
+}
+
+func (self *AMQP) bridge(dst *AMQP, message *Message, transform func(*Message) (*Message, error)) error {
+	out := message
+
+	if transform != nil {
+		var err error
+
+		if out, err = transform(message); err != nil {
+			self.log().Warnf("rejecting message %s: %v", message.ID(), err)
+			return message.Reject()
+		} else if out == nil {
+			return message.Acknowledge()
+		}
+	}
+
+	var err error
+
+	if dst.Confirms {
+		err = dst.PublishConfirm(out.Body, out.Header)
+	} else {
+		err = dst.Publish(out.Body, out.Header)
+	}
+
+	if err != nil {
+		return utils.AppendError(
+			fmt.Errorf("cannot publish message %s to destination: %v", message.ID(), err),
+			message.Requeue(),
+		)
+	}
+
+	return message.Acknowledge()
+}
@@ -2,13 +2,23 @@ package qcat
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/ghetzel/go-stockutil/sliceutil"
 	"github.com/ghetzel/go-stockutil/stringutil"
@@ -17,11 +27,43 @@ import (
 	"github.com/streadway/amqp"
 )
 
+var ErrNotConnected = errors.New("not connected")
+var ErrQueueEmpty = errors.New("queue is empty")
+var ErrIncomplete = errors.New("timed out before all messages were received")
+var ErrHeartbeatTimeout = errors.New("connection lost: no heartbeat received from broker")
+var ErrConnectionLost = errors.New("connection lost")
+var ErrPublishTimeout = errors.New("timed out publishing message")
+var ErrBrokerUnresponsive = errors.New("broker did not respond")
+var ErrAlreadySettled = errors.New("message was already acknowledged or rejected, or its channel has closed")
+
 var DefaultQueueName = `qcat`
+var DefaultExchangeType = `direct`
+var DefaultConsumerTagPrefix = `qcat`
 var DefaultConnectTimeout = 5 * time.Second
+var DefaultConfirmTimeout = 30 * time.Second
+var DefaultBatchWindow = 1000
+var DefaultStreamPrefetch = 100
+var DefaultReconnectBackoff = Backoff{
+	Min: 500 * time.Millisecond,
+	Max: 30 * time.Second,
+}
+
+// Backoff specifies the bounds of the exponentially-increasing delay between reconnection attempts.
+type Backoff struct {
+	Min time.Duration
+	Max time.Duration
+}
 
 type AMQP struct {
+	// accessed atomically, so they come first to keep them 64-bit aligned on 32-bit platforms
+	published uint64
+	consumed  uint64
+
+	// The consumer tag to identify this client's consumers with.  If empty, a unique one is
+	// generated (prefixed with ConsumerTagPrefix) when connecting.
 	ID                string
+	ConsumerTagPrefix string
+
 	Host              string
 	Port              int
 	Username          string
@@ -29,29 +71,262 @@ type AMQP struct {
 	ConnectTimeout    time.Duration
 	HeartbeatInterval time.Duration
 	TLS               *tls.Config
-	Vhost             string
-	ExchangeName      string
-	RoutingKey        string
-	QueueName         string
-	Durable           bool
-	Autodelete        bool
-	Exclusive         bool
-	Mandatory         bool
-	Immediate         bool
-	AutoAck           bool
-	Prefetch          int
-	PrefetchBytes     int
-	PrefetchGlobal    bool
-	Headers           map[string]interface{}
-	ClientProperties  map[string]interface{}
-	conn              *amqp.Connection
-	channel           *amqp.Channel
-	queue             amqp.Queue
-	uri               amqp.URI
-	outchan           chan *Message
-	downstreamErrchan chan *amqp.Error
-	errchan           chan error
-	receiving         bool
+
+	// Shortcuts for common TLS settings, applied on top of TLS (or, if TLS is nil, used to build a
+	// configuration) when connecting to an amqps:// URI.  TLSServerName is the hostname the
+	// broker's certificate is verified against (defaulting to Host), and TLSInsecure skips
+	// verifying the certificate entirely, which should only ever be used for testing.
+	TLSServerName string
+	TLSInsecure   bool
+
+	// The SASL mechanism used to authenticate: "plain" (the default) sends the username and
+	// password, while "external" relies on the client certificate presented over TLS.
+	SASLMechanism string
+
+	// If set, used to open the network connection to the broker instead of dialing it over TCP
+	// (e.g.: to connect over a unix socket or through a proxy).  ConnectTimeout is not applied to
+	// connections made this way.  For amqps:// URIs, TLS is still negotiated over the returned
+	// connection.
+	DialFunc func(network, addr string) (net.Conn, error)
+
+	// The base URL of the RabbitMQ management API (e.g.: "https://rabbit.example.com:15671"), used
+	// for information the AMQP protocol doesn't expose, such as Bindings and ManagementStats.  If
+	// not set, the API is reached on the broker's host at ManagementPort (defaulting to
+	// DefaultManagementPort), over HTTPS if ManagementTLS is set.  Requests authenticate as
+	// ManagementUsername and ManagementPassword, which default to the client's own credentials.
+	ManagementURL      string
+	ManagementPort     int
+	ManagementUsername string
+	ManagementPassword string
+	ManagementTLS      *tls.Config
+
+	Vhost              string
+	ExchangeName       string
+	ExchangeType       string
+	ExchangeDurable    bool
+	ExchangeAutodelete bool
+	RoutingKey         string
+	BindingKeys        []string
+
+	// Declare the exchanges given to PublishFanout as fanout exchanges (using ExchangeDurable and
+	// ExchangeAutodelete) if they don't already exist.  By default they are only verified to exist,
+	// since the settings for ExchangeName may not match those of an exchange declared elsewhere.
+	DeclareFanouts bool
+
+	// A regular expression that the routing key of consumed messages must match.  Messages that
+	// don't match are acknowledged and dropped instead of being passed along to subscribers, which
+	// allows filtering more finely than a topic exchange's binding patterns.
+	RoutingKeyFilter string
+
+	// Messages published to the exchange that can't be routed to any queue are sent to this
+	// exchange instead of being dropped.  The alternate exchange is not declared by the client, so
+	// it should exist (with a queue bound to it) before the exchange is first declared.  Since an
+	// exchange's arguments can't be changed once it exists, an existing exchange must be deleted
+	// and redeclared to add one.
+	AlternateExchange string
+
+	// Skip consumed messages with the same ID as one that has already been acknowledged,
+	// acknowledging them so they aren't delivered again.  IDs are only remembered once a message is
+	// acknowledged (or delivered, with AutoAck), so messages that were requeued, or never settled
+	// before the connection was lost, are still delivered again.  The IDs of the last DedupWindow
+	// such messages are remembered in memory, unless a different Deduplicator is given.  Messages
+	// without an ID are never considered duplicates.
+	DedupWindow int
+	Dedup       Deduplicator
+
+	// Arguments to include when binding the queue to the exchange.  For headers exchanges, this
+	// specifies which message headers to match on, and whether all or any of them must match:
+	//
+	//	client.ExchangeType = `headers`
+	//	client.BindingArguments = map[string]interface{}{
+	//		`x-match`: `any`,
+	//		`format`:  `pdf`,
+	//		`type`:    `report`,
+	//	}
+	//
+	BindingArguments map[string]interface{}
+
+	// Only verify that the exchange and queues already exist instead of creating them, failing to
+	// connect if they don't.  Queues are not bound to the exchange, since the broker's existing
+	// topology is assumed to be correct.
+	Passive bool
+
+	QueueName  string
+	QueueNames []string
+
+	// Consume from a new queue named by the broker instead of QueueName: an exclusive queue that is
+	// deleted when the connection closes, bound to ExchangeName with RoutingKey (or BindingKeys),
+	// e.g.: to tail the messages passing through an exchange.  If the connection is lost, the
+	// reconnected client gets a new queue, and messages published in the meantime are missed.
+	TemporaryQueue bool
+
+	// The type of queue to declare: "classic" (the default), "quorum" (replicated for high
+	// availability), or "stream" (an append-only log).  Quorum and stream queues must be durable,
+	// and cannot be exclusive or auto-deleted.
+	QueueType string
+
+	// Where in a stream queue to start consuming from: "first", "last", "next", an RFC3339
+	// timestamp, or a numeric offset.  Only valid when QueueType is "stream".
+	StreamOffset string
+
+	Durable    bool
+	Autodelete bool
+	Exclusive  bool
+	Mandatory  bool
+	Immediate  bool
+	AutoAck    bool
+
+	// Ask the broker not to deliver messages published on this client's own connection to its
+	// consumers.  RabbitMQ does not implement this and ignores it; other brokers may honour it.
+	NoLocal bool
+
+	// Limits on how many unacknowledged messages (Prefetch) and bytes of message bodies
+	// (PrefetchBytes) the broker will deliver before waiting for acknowledgements; zero means no
+	// limit.  If PrefetchGlobal is set, the limits are shared by all consumers on the connection
+	// instead of applying to each consumer.  Note that RabbitMQ does not implement PrefetchBytes,
+	// and will close the channel if it is non-zero.
+	Prefetch       int
+	PrefetchBytes  int
+	PrefetchGlobal bool
+
+	// The priority of this client's consumers relative to others on the same queue.  The broker
+	// delivers to the highest-priority consumers that have prefetch capacity, only falling back to
+	// lower-priority ones when those are busy, which suits active/standby setups.  Zero is the
+	// normal priority; negative values are lower still.
+	ConsumerPriority int
+
+	MaxPriority int
+
+	// Declare the queue so that only one of its consumers receives messages at a time, with the
+	// broker failing over to another consumer if the active one goes away.  Unlike Exclusive, the
+	// queue is shared by any number of connections and survives the declaring connection closing.
+	SingleActiveConsumer bool
+
+	// Limit how many messages (MaxLength) or bytes of message bodies (MaxLengthBytes) the queue
+	// will hold.  Overflow controls what happens when a limit is reached: "drop-head" (the
+	// default) discards the oldest messages, "reject-publish" refuses new ones, and
+	// "reject-publish-dlx" refuses new ones and dead-letters them.
+	MaxLength      int
+	MaxLengthBytes int
+	Overflow       string
+
+	// Declare a classic queue as lazy, so that messages are kept on disk rather than in memory
+	// wherever possible.  Quorum and stream queues always behave this way and don't accept the
+	// option, so setting it for them is an error.
+	Lazy bool
+
+	// Messages that are rejected without being requeued (or that expire) will be republished to
+	// this exchange, optionally with their routing key replaced by DeadLetterRoutingKey.  Note
+	// that Message.Requeue() returns messages to the original queue and does not dead-letter them;
+	// a consumer that always requeues a poison message will receive it again forever.
+	DeadLetterExchange   string
+	DeadLetterRoutingKey string
+
+	// The name of an x-delayed-message exchange (provided by the rabbitmq_delayed_message_exchange
+	// plugin) that Message.RequeueAfter() republishes messages to.  The exchange must route
+	// messages back to the original queue using their original routing key.
+	DelayExchange string
+
+	Headers map[string]interface{}
+
+	// Properties identifying the client to the broker (shown in its management interface).  If
+	// not set, "product", "version", and "hostname" are filled in when connecting.  The
+	// "capabilities" table is always set to advertise support for connection.blocked and
+	// consumer_cancel_notify (which NotifyBlocked and NotifyConsumerCancel rely on); the underlying
+	// AMQP library does not allow it to be overridden.
+	ClientProperties map[string]interface{}
+
+	// The name RabbitMQ shows for this client's connection in its management interface, sent as
+	// the "connection_name" client property.  If neither this nor that property is set, it
+	// defaults to "qcat-<hostname>-<pid>".
+	ConnectionName string
+
+	// Called (in a goroutine of their own, so they may block) whenever the client's channel or
+	// connection is closed by an error, before the error is reported on Err() or a reconnect is
+	// attempted; e.g.: to reset application state that depends on the connection.  Losing the
+	// connection closes the channel too, so both callbacks are called in that case.  Neither is
+	// called when the client is closed normally.
+	OnChannelClose func(*amqp.Error)
+	OnConnClose    func(*amqp.Error)
+
+	AutoReconnect    bool
+	ReconnectBackoff Backoff
+	Confirms         bool
+	ConfirmTimeout   time.Duration
+	Metrics          Metrics
+	Logger           Logger
+	BatchWindow      int
+	CompressPublish  bool
+	CompressCodec    string
+	CompressMinBytes int
+
+	// If greater than zero, refuse to publish message bodies larger than this many bytes (before
+	// compression).  PublishLines and PublishJSONLines return an error on the first oversized line,
+	// unless SkipOversized is set, in which case those lines are logged and skipped.
+	MaxMessageBytes int
+	SkipOversized   bool
+
+	// Guess the ContentType of published messages that don't specify one (or a ContentEncoding)
+	// from their bodies: application/json for valid JSON, text/plain for other valid UTF-8, and
+	// application/octet-stream for anything else.
+	SniffContentType bool
+
+	PublishRate    float64
+	PublishTimeout time.Duration
+
+	// If set (and AutoAck is off), messages delivered by Subscribe that are not acknowledged or
+	// rejected within this long are requeued automatically, so a handler that forgets to settle
+	// a message doesn't hold on to it forever.
+	AckDeadline time.Duration
+
+	// Deliver messages from each queue strictly in order: Subscribe waits for each message to be
+	// acknowledged or rejected before delivering the next, and the broker is asked to deliver
+	// only one message at a time (overriding Prefetch).  If the connection is lost while a message
+	// is outstanding, the broker redelivers it (with Redelivered set) ahead of any newer ones once
+	// AutoReconnect has reestablished the connection.  This limits throughput to one message per
+	// round trip to the broker, and requires AutoAck to be off.
+	StrictOrdering bool
+
+	// Follow each message body written by Message.WriteTo with a newline.
+	WriteNewline bool
+
+	// Controls the pacing of ReplayTimed: ReplaySpeed scales the original gaps between messages
+	// (2 replays twice as fast; zero or less means 1), and ReplayMaxDelay caps how long any one gap
+	// may be (zero is unlimited).
+	ReplaySpeed      float64
+	ReplayMaxDelay   time.Duration
+	conn             *amqp.Connection
+	channel          *amqp.Channel
+	confirms         *confirmTracker
+	queue            amqp.Queue
+	queues           []amqp.Queue
+	consumerTags     map[string]bool
+	unacked          map[deliveryKey]*Message
+	unackedLock      sync.Mutex
+	limiter          rateLimiter
+	inTransaction    bool
+	fanouts          map[string]bool
+	routingKeyFilter *regexp.Regexp
+	uri              amqp.URI
+	outchan          chan *Message
+	outchanClosed    bool
+	errchan          chan error
+	reconnectchan    chan struct{}
+	blockedchan      chan amqp.Blocking
+	returnchan       chan *Message
+	cancelchan       chan string
+	unblocked        chan struct{}
+	flowPaused       chan struct{}
+	receiving        bool
+	closing          bool
+	ready            chan struct{}
+	stateLock        sync.RWMutex
+}
+
+type QueueStats struct {
+	QueueName string
+	Messages  int
+	Consumers int
 }
 
 type DeliveryMode int
@@ -61,24 +336,61 @@ const (
 	Persistent              = 2
 )
 
+func (self DeliveryMode) String() string {
+	switch self {
+	case Transient:
+		return `transient`
+	case Persistent:
+		return `persistent`
+	default:
+		return ``
+	}
+}
+
 type MessageHeader struct {
-	ID              string
+	ID              string // the AMQP message-id property; generated on publish if empty
 	ContentType     string
 	ContentEncoding string
 	DeliveryMode    DeliveryMode
 	Priority        int
 	Expiration      time.Duration
+	ExpiresAt       time.Time // expire at this time instead of (or, if sooner, as well as) after Expiration
+	CorrelationId   string
+	ReplyTo         string
+	AppId           string
+	UserId          string // if set, the broker will verify it matches the connection's username
+	Type            string
 	Headers         map[string]interface{}
 }
 
 type Message struct {
-	Timestamp   time.Time
-	Header      MessageHeader
-	Body        []byte
+	Timestamp time.Time
+	Header    MessageHeader
+	Body      []byte
+	Queue     string
+
+	// The routing key the message was published with.
+	RoutingKey string
+
+	// Whether the broker has delivered this message before (e.g.: it was requeued, or a previous
+	// consumer went away without acknowledging it).
+	Redelivered bool
+
+	// The number of times this message has been dead-lettered, as recorded by the broker in
+	// the x-death header.  This is zero for messages that have never been dead-lettered.
+	DeliveryCount int
+
+	// For messages the broker returned as unroutable (see AMQP.NotifyReturn), the reply code and
+	// text explaining why.
+	ReturnCode   int
+	ReturnReason string
+
+	client      *AMQP
 	delivery    *amqp.Delivery
 	id          string
 	channel     *amqp.Channel
 	ackRequired bool
+	settledchan chan struct{}
 }
 
 func (self *Message) ID() string {
@@ -126,13 +438,18 @@ func (self *Message) Acknowledge(multiple ...bool) error {
 			multi = true
 		}
 
-		return self.channel.Ack(self.delivery.DeliveryTag, multi)
+		if err := self.claim(multi); err != nil {
+			return err
+		}
+
+		return self.settled(multi, true, self.channel.Ack(self.delivery.DeliveryTag, multi))
 	} else {
 		return nil
 	}
 }
 
-// Reject a message, but don't requeue it.
+// Reject a message, but don't requeue it.  If the queue has a dead-letter exchange configured,
+// the message will be routed there.
 func (self *Message) Reject(multiple ...bool) error {
 	if self.channel == nil {
 		return fmt.Errorf("no channel set")
@@ -144,13 +461,19 @@ func (self *Message) Reject(multiple ...bool) error {
 		if len(multiple) > 0 && multiple[0] {
 			multi = true
 		}
-		return self.channel.Nack(self.delivery.DeliveryTag, multi, false)
+
+		if err := self.claim(multi); err != nil {
+			return err
+		}
+
+		return self.settled(multi, false, self.channel.Nack(self.delivery.DeliveryTag, multi, false))
 	} else {
 		return nil
 	}
 }
 
-// Reject a message and requeue it.
+// Reject a message and requeue it.  Requeued messages go back to the queue they came from, not to
+// the dead-letter exchange.
 func (self *Message) Requeue(multiple ...bool) error {
 	if self.channel == nil {
 		return fmt.Errorf("no channel set")
@@ -163,278 +486,3215 @@ func (self *Message) Requeue(multiple ...bool) error {
 			multi = true
 		}
 
-		return self.channel.Nack(self.delivery.DeliveryTag, multi, true)
+		if err := self.claim(multi); err != nil {
+			return err
+		}
+
+		return self.settled(multi, false, self.channel.Nack(self.delivery.DeliveryTag, multi, true))
 	} else {
 		return nil
 	}
 }
 
-func (self *Message) Decode(into interface{}) error {
-	switch self.Header.ContentType {
-	case `application/json`:
-		return json.Unmarshal(self.Body, into)
-	default:
-		if b, ok := into.([]byte); ok {
-			if n := copy(b, self.Body); n == 0 && len(self.Body) > 0 {
-				return fmt.Errorf("target must be able to hold at least %d bytes", len(self.Body))
-			} else {
-				return nil
-			}
-		} else {
-			return typeutil.SetValue(into, string(self.Body))
-		}
+// Requeue a message so that it is redelivered after the given delay, rather than immediately.  The
+// message is republished to the client's DelayExchange with an x-delay header, and the original
+// is acknowledged once the copy has been published (and confirmed, if Confirms is enabled).  The
+// copy keeps the original MessageId, so if DedupWindow is set it will be dropped as a duplicate.
+func (self *Message) RequeueAfter(delay time.Duration) error {
+	if self.client == nil || self.delivery == nil {
+		return fmt.Errorf("message was not received from a broker")
 	}
+
+	return self.client.requeueAfter(self, delay)
 }
 
-func NewAMQP(uri string) (*AMQP, error) {
-	c := &AMQP{
-		QueueName:         DefaultQueueName,
-		Headers:           make(map[string]interface{}),
-		AutoAck:           true,
-		ConnectTimeout:    DefaultConnectTimeout,
-		ClientProperties:  make(map[string]interface{}),
-		outchan:           make(chan *Message),
-		downstreamErrchan: make(chan *amqp.Error),
-		errchan:           make(chan error),
+// Republish a copy of the message to the exchange and routing key it was originally published
+// with, after letting modify change its header, then acknowledge the original.  This allows retries
+// to be tracked by the application (e.g.: by incrementing a counter header) without a round trip
+// through a dead-letter exchange.  Since the copy goes back through the same routing, a message
+// that always fails would be retried forever, so callers should give up past some limit.  The copy
+// keeps the original MessageId, so if DedupWindow is set it will be dropped as a duplicate unless
+// modify assigns a new one.
+//
+//	if retries, _ := msg.Header.Headers[`x-retries`].(int64); retries >= 5 {
+//		return msg.Reject()
+//	}
+//
+//	return msg.RequeueModified(func(header *MessageHeader) {
+//		header.Headers[`x-retries`] = retries + 1
+//	})
+func (self *Message) RequeueModified(modify func(*MessageHeader)) error {
+	if self.client == nil || self.delivery == nil {
+		return fmt.Errorf("message was not received from a broker")
 	}
 
-	if u, err := amqp.ParseURI(uri); err == nil {
-		c.uri = u
-		c.Host = u.Host
-		c.Port = u.Port
-		c.Username = u.Username
-		c.Password = u.Password
-		c.Vhost = u.Vhost
+	return self.client.requeueModified(self, modify)
+}
 
-		return c, nil
-	} else {
-		return nil, err
+// take responsibility for settling a single message, so that it can't be acknowledged or rejected
+// more than once (which the broker treats as a channel error), e.g.: by the caller racing an
+// AckDeadline expiring.
+func (self *Message) claim(multiple bool) error {
+	if !multiple && self.client != nil && !self.client.claimDelivery(self.channel, self.DeliveryTag()) {
+		return ErrAlreadySettled
 	}
+
+	return nil
 }
 
-func (self *AMQP) Close() error {
-	var merr error
+func (self *Message) settled(multiple bool, acked bool, err error) error {
+	if self.client != nil {
+		err = self.client.settled(self.channel, self.DeliveryTag(), multiple, acked, err)
 
-	if self.conn == nil {
-		return fmt.Errorf("Cannot close, connection does not exist")
-	} else if self.channel != nil {
-		if err := self.channel.Cancel(self.ID, false); err != nil {
-			merr = utils.AppendError(merr, err)
+		// a single message was already untracked when it was claimed, so remember it here
+		if err == nil && acked {
+			self.client.remember(self)
 		}
 
-		for self.receiving {
-			time.Sleep(50 * time.Millisecond)
-		}
+		return err
+	} else {
+		return err
+	}
+}
+
+// Serialize the message and its header as a JSON object.  The body is included as a string if it
+// is valid UTF-8, otherwise it is base64-encoded and "body_encoding" is set to "base64".
+func (self *Message) MarshalJSON() ([]byte, error) {
+	header := map[string]interface{}{
+		`content_type`:     self.Header.ContentType,
+		`content_encoding`: self.Header.ContentEncoding,
+		`delivery_mode`:    self.Header.DeliveryMode.String(),
+		`priority`:         self.Header.Priority,
+	}
+
+	if self.Header.Expiration > 0 {
+		header[`expiration`] = self.Header.Expiration.String()
+	}
+
+	if self.Header.CorrelationId != `` {
+		header[`correlation_id`] = self.Header.CorrelationId
+	}
+
+	if self.Header.ReplyTo != `` {
+		header[`reply_to`] = self.Header.ReplyTo
+	}
+
+	if self.Header.ID != `` {
+		header[`message_id`] = self.Header.ID
+	}
+
+	if self.Header.AppId != `` {
+		header[`app_id`] = self.Header.AppId
+	}
+
+	if self.Header.UserId != `` {
+		header[`user_id`] = self.Header.UserId
+	}
+
+	if self.Header.Type != `` {
+		header[`type`] = self.Header.Type
+	}
+
+	if len(self.Header.Headers) > 0 {
+		header[`headers`] = self.Header.Headers
+	}
+
+	envelope := map[string]interface{}{
+		`timestamp`: self.Timestamp,
+		`header`:    header,
+	}
+
+	if self.Queue != `` {
+		envelope[`queue`] = self.Queue
+	}
+
+	if self.RoutingKey != `` {
+		envelope[`routing_key`] = self.RoutingKey
+	}
+
+	if self.Redelivered {
+		envelope[`redelivered`] = true
+	}
+
+	if self.DeliveryCount > 0 {
+		envelope[`delivery_count`] = self.DeliveryCount
+	}
 
-		merr = utils.AppendError(merr, self.channel.Close())
+	if utf8.Valid(self.Body) {
+		envelope[`body`] = string(self.Body)
+	} else {
+		envelope[`body`] = base64.StdEncoding.EncodeToString(self.Body)
+		envelope[`body_encoding`] = `base64`
 	}
 
-	return utils.AppendError(merr, self.conn.Close())
+	return json.Marshal(envelope)
 }
 
-func (self *AMQP) Connect() error {
-	if _, ok := self.ClientProperties[`product`]; !ok {
-		self.ClientProperties[`product`] = `qcat`
-		self.ClientProperties[`version`] = Version
+// Populate the message from the JSON object produced by MarshalJSON, so that messages captured to a
+// file can be read back (e.g.: for ReplayTimed).  The result was not received from a broker, so it
+// cannot be acknowledged or rejected.
+func (self *Message) UnmarshalJSON(data []byte) error {
+	var envelope struct {
+		Timestamp     time.Time `json:"timestamp"`
+		Queue         string    `json:"queue"`
+		RoutingKey    string    `json:"routing_key"`
+		Redelivered   bool      `json:"redelivered"`
+		DeliveryCount int       `json:"delivery_count"`
+		Body          string    `json:"body"`
+		BodyEncoding  string    `json:"body_encoding"`
+		Header        struct {
+			ContentType     string                 `json:"content_type"`
+			ContentEncoding string                 `json:"content_encoding"`
+			DeliveryMode    string                 `json:"delivery_mode"`
+			Priority        int                    `json:"priority"`
+			Expiration      string                 `json:"expiration"`
+			CorrelationId   string                 `json:"correlation_id"`
+			ReplyTo         string                 `json:"reply_to"`
+			MessageId       string                 `json:"message_id"`
+			AppId           string                 `json:"app_id"`
+			UserId          string                 `json:"user_id"`
+			Type            string                 `json:"type"`
+			Headers         map[string]interface{} `json:"headers"`
+		} `json:"header"`
 	}
 
-	if _, ok := self.ClientProperties[`hostname`]; !ok {
-		if hostname, err := os.Hostname(); err == nil {
-			self.ClientProperties[`hostname`] = hostname
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return err
+	}
+
+	header := MessageHeader{
+		ID:              envelope.Header.MessageId,
+		ContentType:     envelope.Header.ContentType,
+		ContentEncoding: envelope.Header.ContentEncoding,
+		Priority:        envelope.Header.Priority,
+		CorrelationId:   envelope.Header.CorrelationId,
+		ReplyTo:         envelope.Header.ReplyTo,
+		AppId:           envelope.Header.AppId,
+		UserId:          envelope.Header.UserId,
+		Type:            envelope.Header.Type,
+		Headers:         envelope.Header.Headers,
+	}
+
+	switch envelope.Header.DeliveryMode {
+	case Transient.String():
+		header.DeliveryMode = Transient
+	case DeliveryMode(Persistent).String():
+		header.DeliveryMode = Persistent
+	case ``:
+	default:
+		return fmt.Errorf("invalid delivery mode %q", envelope.Header.DeliveryMode)
+	}
+
+	if envelope.Header.Expiration != `` {
+		if expiration, err := time.ParseDuration(envelope.Header.Expiration); err == nil {
+			header.Expiration = expiration
+		} else {
+			return fmt.Errorf("invalid expiration: %v", err)
 		}
 	}
 
-	if conn, err := amqp.DialConfig(self.uri.String(), amqp.Config{
-		TLSClientConfig: self.TLS,
-		Properties:      amqp.Table(self.ClientProperties),
-		Heartbeat:       self.HeartbeatInterval,
-		Dial: func(network, addr string) (net.Conn, error) {
-			return net.DialTimeout(network, addr, self.ConnectTimeout)
-		},
-	}); err == nil {
-		self.conn = conn
+	var body []byte
 
-		if channel, err := self.conn.Channel(); err == nil {
-			if err := channel.Qos(self.Prefetch, self.PrefetchBytes, self.PrefetchGlobal); err != nil {
-				return err
-			}
+	switch envelope.BodyEncoding {
+	case `base64`:
+		if decoded, err := base64.StdEncoding.DecodeString(envelope.Body); err == nil {
+			body = decoded
+		} else {
+			return fmt.Errorf("invalid body: %v", err)
+		}
+	case ``:
+		body = []byte(envelope.Body)
+	default:
+		return fmt.Errorf("unsupported body encoding %q", envelope.BodyEncoding)
+	}
 
-			self.channel = channel
+	*self = Message{
+		Timestamp:     envelope.Timestamp,
+		Body:          body,
+		Queue:         envelope.Queue,
+		RoutingKey:    envelope.RoutingKey,
+		Redelivered:   envelope.Redelivered,
+		DeliveryCount: envelope.DeliveryCount,
+		Header:        header,
+	}
 
-			// setup error notifications
-			go func() {
-				for qerr := range self.channel.NotifyClose(self.downstreamErrchan) {
-					if qerr.Server {
-						self.errchan <- fmt.Errorf("server error %d: %v", qerr.Code, qerr.Reason)
-					} else {
-						self.errchan <- fmt.Errorf("client error %d: %v", qerr.Code, qerr.Reason)
-					}
-				}
-			}()
+	return nil
+}
 
-			//  declare queue
-			if self.QueueName != `` {
-				if queue, err := self.channel.QueueDeclare(
-					self.QueueName,
-					self.Durable,
-					self.Autodelete,
-					self.Exclusive,
-					false,
-					amqp.Table(self.Headers),
-				); err == nil {
-					self.queue = queue
-					return nil
-				} else {
-					defer self.channel.Close()
-					return err
-				}
-			}
+// Decode the message body into the given value using the codec registered for its Content-Type
+// (JSON, msgpack, and YAML are supported out of the box; see RegisterCodec), decompressing it first
+// if a supported Content-Encoding is set.  Other content types are copied into a []byte target or
+// converted from a string.  Empty bodies are never passed to a codec (most of which would reject
+// them), and leave the target unchanged.
+func (self *Message) Decode(into interface{}) error {
+	body, err := decompress(self.Header.ContentEncoding, self.Body)
+
+	if err != nil {
+		return err
+	}
+
+	if len(body) == 0 {
+		if _, ok := codecFor(self.Header.ContentType); ok {
+			return nil
+		}
+	}
+
+	if c, ok := codecFor(self.Header.ContentType); ok && c.decode != nil {
+		return c.decode(body, into)
+	} else if b, ok := into.([]byte); ok {
+		if n := copy(b, body); n == 0 && len(body) > 0 {
+			return fmt.Errorf("target must be able to hold at least %d bytes", len(body))
 		} else {
-			defer self.conn.Close()
-			return err
+			return nil
 		}
 	} else {
-		return err
+		return typeutil.SetValue(into, string(body))
 	}
+}
 
-	return nil
+// Return whether the message has an empty body, as is common for messages used purely as signals
+// (where the headers, if anything, carry the information).
+func (self *Message) IsEmpty() bool {
+	return len(self.Body) == 0
 }
 
-func (self *AMQP) SubscribeRaw() (<-chan amqp.Delivery, error) {
-	return self.channel.Consume(
-		self.queue.Name,
-		self.ID,
-		self.AutoAck,
-		self.Exclusive,
-		false,
-		false,
-		amqp.Table(self.Headers),
-	)
+// Return a reader over the message body exactly as it was received, for passing the body along to
+// an io.Writer (a file, an HTTP response, etc.) without copying it.
+func (self *Message) Reader() io.Reader {
+	return bytes.NewReader(self.Body)
 }
 
-// Publish messages read from the given reader, separated by newlines ("\n").
-func (self *AMQP) PublishLines(reader io.Reader, header MessageHeader) error {
-	inScanner := bufio.NewScanner(reader)
+// Return a reader that yields the message body decompressed according to its Content-Encoding, so
+// that large compressed bodies can be streamed to a writer without holding the decompressed copy
+// in memory.  The reader should be closed when done.
+func (self *Message) DecompressedReader() (io.ReadCloser, error) {
+	// an empty body is never compressed, whatever its Content-Encoding says
+	if self.IsEmpty() {
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
 
-	for inScanner.Scan() {
-		if err := self.Publish([]byte(inScanner.Bytes()), header); err != nil {
-			return err
-		}
+	return decompressReader(self.Header.ContentEncoding, bytes.NewReader(self.Body))
+}
+
+// Write the message body to the given writer, followed by a newline if the client that received
+// it has WriteNewline set.  This makes Message an io.WriterTo.
+func (self *Message) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(self.Body)
+	total := int64(n)
+
+	if err == nil && self.client != nil && self.client.WriteNewline {
+		n, err = w.Write([]byte{'\n'})
+		total += int64(n)
 	}
 
-	return inScanner.Err()
+	return total, err
 }
 
-// Publish a single message.
-func (self *AMQP) Publish(data []byte, header MessageHeader) error {
-	var deliveryMode int
+func NewAMQP(uri string) (*AMQP, error) {
+	if u, err := amqp.ParseURI(uri); err == nil {
+		return NewAMQPFromURI(u), nil
+	} else {
+		return nil, err
+	}
+}
 
-	switch header.DeliveryMode {
-	case Transient:
-		deliveryMode = 1
-	case Persistent:
-		deliveryMode = 2
+// Create a client that connects using the given URI, for callers that assemble the connection
+// details themselves (e.g.: from separately-stored credentials) rather than parsing a string.
+func NewAMQPFromURI(uri amqp.URI) *AMQP {
+	c := &AMQP{
+		QueueName:        DefaultQueueName,
+		Headers:          make(map[string]interface{}),
+		AutoAck:          true,
+		ConnectTimeout:   DefaultConnectTimeout,
+		ClientProperties: make(map[string]interface{}),
+		ReconnectBackoff: DefaultReconnectBackoff,
+		ConfirmTimeout:   DefaultConfirmTimeout,
+		Metrics:          NoopMetrics{},
+		Logger:           NoopLogger{},
+		BatchWindow:      DefaultBatchWindow,
+		outchan:          make(chan *Message),
+		errchan:          make(chan error),
+		reconnectchan:    make(chan struct{}, 1),
+		blockedchan:      make(chan amqp.Blocking, 8),
+		returnchan:       make(chan *Message, 64),
+		cancelchan:       make(chan string, 8),
+		consumerTags:     make(map[string]bool),
 	}
 
-	pubOpts := amqp.Publishing{
-		Body:            data,
-		ContentType:     header.ContentType,
-		ContentEncoding: header.ContentEncoding,
-		DeliveryMode:    uint8(deliveryMode),
-		Priority:        uint8(header.Priority),
-		Timestamp:       time.Now(),
-		Headers:         amqp.Table(header.Headers),
-		MessageId: sliceutil.OrString(
-			header.ID,
-			stringutil.UUID().String(),
-		),
+	c.SetURI(uri)
+
+	return c
+}
+
+// Replace the URI used to connect to the broker, along with the Host, Port, Username, Password,
+// and Vhost fields derived from it.  This takes effect the next time the client connects.  For
+// amqps:// URIs, TLS is set to a default configuration that verifies the broker's certificate
+// against the system's root CAs, unless a configuration has already been provided.  The default
+// leaves ServerName empty, so the certificate is checked against whatever Host is when dialing.
+func (self *AMQP) SetURI(uri amqp.URI) {
+	self.uri = uri
+	self.Host = uri.Host
+	self.Port = uri.Port
+	self.Username = uri.Username
+	self.Password = uri.Password
+	self.Vhost = uri.Vhost
+
+	if uri.Scheme == `amqps` && self.TLS == nil {
+		self.TLS = &tls.Config{}
 	}
+}
 
-	if header.Expiration > 0 {
-		pubOpts.Expiration = fmt.Sprintf("%d", int(
-			header.Expiration.Round(time.Millisecond)/time.Millisecond,
-		))
+// Return the URI used to connect to the broker, including the password.  Changes to the Host,
+// Port, Username, Password, and Vhost fields made since the client was created are reflected in
+// it.  This should not be logged or displayed; use SafeURI for that.
+func (self *AMQP) DialURI() string {
+	return self.connectionURI().String()
+}
+
+// Return the URI used to connect to the broker with the password redacted, suitable for logging.
+func (self *AMQP) SafeURI() string {
+	uri := self.connectionURI()
+
+	if uri.Password != `` {
+		// a placeholder is used because asterisks would be percent-encoded by String()
+		uri.Password = `redacted`
+
+		return strings.Replace(uri.String(), `:redacted@`, `:****@`, 1)
 	}
 
-	return self.channel.Publish(self.ExchangeName, self.RoutingKey, self.Mandatory, self.Immediate, pubOpts)
+	return uri.String()
 }
 
-// Publish a single message serialized as JSON.
-func (self *AMQP) PublishJSON(body interface{}, header MessageHeader) error {
-	if data, err := json.Marshal(body); err == nil {
-		if header.ContentType == `` {
-			header.ContentType = `application/json`
+func (self *AMQP) connectionURI() amqp.URI {
+	uri := self.uri
+	uri.Host = self.Host
+	uri.Port = self.Port
+	uri.Username = self.Username
+	uri.Password = self.Password
+	uri.Vhost = self.Vhost
+
+	return uri
+}
+
+// Return the virtual host the client connects to.  An empty Vhost field means the broker's
+// default vhost ("/").
+func (self *AMQP) VirtualHost() string {
+	return sliceutil.OrString(self.Vhost, `/`)
+}
+
+func (self *AMQP) Close() error {
+	var merr error
+
+	self.stateLock.Lock()
+	self.closing = true
+	conn, channel := self.conn, self.channel
+	tags := make([]string, 0, len(self.consumerTags))
+
+	for tag := range self.consumerTags {
+		tags = append(tags, tag)
+	}
+
+	self.stateLock.Unlock()
+
+	if conn == nil {
+		return ErrNotConnected
+	} else if channel != nil {
+		for _, tag := range tags {
+			if err := channel.Cancel(tag, false); err != nil {
+				merr = utils.AppendError(merr, err)
+			}
 		}
 
-		return self.Publish(data, header)
-	} else {
-		return fmt.Errorf("serialization error: %v", err)
+		for self.isReceiving() {
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		merr = utils.AppendError(merr, channel.Close())
 	}
+
+	return utils.AppendError(merr, conn.Close())
 }
 
-// Receive a message from the channel.
-func (self *AMQP) Subscribe() error {
-	if msgs, err := self.SubscribeRaw(); err == nil {
-		go func() {
-			self.receiving = true
+// Stop receiving new messages, wait up to the given timeout for all messages that have already
+// been delivered to be acknowledged or rejected, then close the connection.
+func (self *AMQP) CloseGraceful(timeout time.Duration) error {
+	var merr error
 
-			for delivery := range msgs {
-				var deliveryMode DeliveryMode
+	self.stateLock.Lock()
+	self.closing = true
+	channel := self.channel
+	tags := make([]string, 0, len(self.consumerTags))
 
-				switch delivery.DeliveryMode {
-				case 2:
-					deliveryMode = Persistent
-				default:
-					deliveryMode = Transient
-				}
+	for tag := range self.consumerTags {
+		tags = append(tags, tag)
+	}
 
-				self.outchan <- &Message{
-					delivery:    &delivery,
-					channel:     self.channel,
-					ackRequired: !self.AutoAck,
-					Timestamp:   delivery.Timestamp,
-					Body:        delivery.Body,
-					Header: MessageHeader{
-						ContentType:     delivery.ContentType,
-						ContentEncoding: delivery.ContentEncoding,
-						DeliveryMode:    deliveryMode,
-						Priority:        int(delivery.Priority),
-						Headers:         typeutil.MapNative(delivery.Headers),
-					},
-				}
+	self.stateLock.Unlock()
+
+	if channel != nil {
+		for _, tag := range tags {
+			if err := channel.Cancel(tag, false); err != nil {
+				merr = utils.AppendError(merr, err)
 			}
+		}
+	}
 
-			close(self.outchan)
-			self.receiving = false
-		}()
+	deadline := time.Now().Add(timeout)
 
-		return nil
-	} else {
-		return err
+	for self.Unacked() > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
 	}
-}
 
-// Receive a single message.
-func (self *AMQP) Receive() <-chan *Message {
-	return self.outchan
-}
+	if n := self.Unacked(); n > 0 {
+		merr = utils.AppendError(merr, fmt.Errorf("closing with %d unacknowledged message(s)", n))
+	}
 
-// Receive a single error.
-func (self *AMQP) Err() <-chan error {
-	return self.errchan
+	return utils.AppendError(merr, self.Close())
 }
 
-// Acknowledge a message by its Delivery tag
-func (self *AMQP) Acknowledge(tag uint64) error {
-	return self.channel.Ack(tag, false)
+func (self *AMQP) Connect() error {
+	return self.ConnectContext(context.Background())
 }
 
-// Reject a message by its Delivery tag
-func (self *AMQP) Reject(tag uint64) error {
-	return self.channel.Nack(tag, false, false)
+// Connect to the broker, making up to the given number of attempts (or retrying forever, if
+// attempts is negative) before returning the last error.  Each attempt is subject to
+// ConnectTimeout, and the delay between attempts starts at backoff and doubles after every
+// failure, up to the Max of ReconnectBackoff.
+func (self *AMQP) ConnectRetry(attempts int, backoff time.Duration) error {
+	var err error
+
+	delay := backoff
+	max := self.backoff().Max
+
+	if max < backoff {
+		max = backoff
+	}
+
+	for attempt := 1; attempts < 0 || attempt <= attempts || attempt == 1; attempt++ {
+		if err = self.Connect(); err == nil {
+			return nil
+		} else if attempts >= 0 && attempt >= attempts {
+			break
+		}
+
+		self.log().Warnf("connect attempt %d failed, retrying in %v: %v", attempt, delay, err)
+		time.Sleep(delay)
+
+		if delay *= 2; delay > max {
+			delay = max
+		}
+	}
+
+	return err
 }
 
-// Requeue a message by its Delivery tag
-func (self *AMQP) Requeue(tag uint64) error {
-	return self.channel.Nack(tag, false, true)
+// Connect to the broker, aborting the attempt if the given context is cancelled.  If the context
+// has a deadline sooner than ConnectTimeout, it will be used as the dial timeout instead.
+func (self *AMQP) ConnectContext(ctx context.Context) error {
+	if self.ClientProperties == nil {
+		self.ClientProperties = make(map[string]interface{})
+	}
+
+	if _, ok := self.ClientProperties[`product`]; !ok {
+		self.ClientProperties[`product`] = `qcat`
+		self.ClientProperties[`version`] = Version
+	}
+
+	if _, ok := self.ClientProperties[`hostname`]; !ok {
+		if hostname, err := os.Hostname(); err == nil {
+			self.ClientProperties[`hostname`] = hostname
+		}
+	}
+
+	if self.ConnectionName != `` {
+		self.ClientProperties[`connection_name`] = self.ConnectionName
+	} else if _, ok := self.ClientProperties[`connection_name`]; !ok {
+		hostname, _ := os.Hostname()
+
+		self.ClientProperties[`connection_name`] = fmt.Sprintf(
+			"qcat-%s-%d",
+			sliceutil.OrString(hostname, `unknown`),
+			os.Getpid(),
+		)
+	}
+
+	if _, ok := self.ClientProperties[`capabilities`]; ok {
+		self.log().Warnf("client capabilities cannot be overridden and will be ignored")
+	}
+
+	// without a consumer tag, the library generates one we can't later use to cancel the consumer
+	if self.ID == `` {
+		self.ID = self.generateConsumerTag()
+	}
+
+	self.stateLock.Lock()
+	self.closing = false
+	self.stateLock.Unlock()
+
+	return self.connect(ctx)
+}
+
+// dial the broker, open a channel, and declare the queue; replacing any existing connection
+// state on success.
+func (self *AMQP) connect(ctx context.Context) error {
+	if conn, err := self.dial(ctx); err == nil {
+		self.log().Infof("connected to %s", self.SafeURI())
+
+		if frameMax := conn.Config.FrameSize; frameMax > 0 && self.MaxMessageBytes > frameMax {
+			self.log().Warnf("messages of up to %d bytes (MaxMessageBytes) exceed the broker's frame size of %d bytes, and will be split across frames", self.MaxMessageBytes, frameMax)
+		}
+
+		if channel, err := conn.Channel(); err == nil {
+			self.log().Debugf("channel opened")
+
+			if err := channel.Qos(self.prefetch(), self.PrefetchBytes, self.PrefetchGlobal); err != nil {
+				defer conn.Close()
+				return err
+			}
+
+			var queues []amqp.Queue
+			var confirms *confirmTracker
+
+			if self.Confirms {
+				if err := channel.Confirm(false); err == nil {
+					confirms = newConfirmTracker(channel.NotifyPublish(make(chan amqp.Confirmation, 64)))
+				} else {
+					defer conn.Close()
+					return err
+				}
+			}
+
+			if q, err := self.declare(channel); err == nil {
+				queues = q
+			} else {
+				defer conn.Close()
+				return err
+			}
+
+			self.stateLock.Lock()
+			self.conn = conn
+			self.channel = channel
+			self.confirms = confirms
+			self.queues = queues
+			self.inTransaction = false
+			self.setBlocked(false)
+			self.setFlow(true)
+			self.fanouts = nil
+
+			if len(queues) > 0 {
+				self.queue = queues[0]
+			}
+
+			self.stateLock.Unlock()
+
+			// setup error notifications
+			go self.watch(conn, channel)
+			go self.watchBlocked(conn)
+			go self.watchConnClose(conn)
+			go self.watchReturns(channel)
+			go self.watchFlow(channel)
+			go self.watchCancels(channel)
+
+			return nil
+		} else {
+			defer conn.Close()
+			return err
+		}
+	} else {
+		return err
+	}
+}
+
+// declare the exchange and queue(s) (if configured) on the given channel.
+func (self *AMQP) declare(channel *amqp.Channel) ([]amqp.Queue, error) {
+	queues := make([]amqp.Queue, 0)
+
+	exchangeDeclare := channel.ExchangeDeclare
+	queueDeclare := channel.QueueDeclare
+
+	if self.Passive {
+		exchangeDeclare = channel.ExchangeDeclarePassive
+		queueDeclare = channel.QueueDeclarePassive
+	}
+
+	var exchangeArgs amqp.Table
+
+	if self.AlternateExchange != `` {
+		exchangeArgs = amqp.Table{
+			`alternate-exchange`: self.AlternateExchange,
+		}
+	}
+
+	//  declare exchange
+	if self.ExchangeName != `` {
+		if err := exchangeDeclare(
+			self.ExchangeName,
+			sliceutil.OrString(self.ExchangeType, DefaultExchangeType),
+			self.ExchangeDurable,
+			self.ExchangeAutodelete,
+			false,
+			false,
+			exchangeArgs,
+		); err != nil {
+			if self.Passive && isNotFound(err) {
+				return nil, fmt.Errorf("exchange %q does not exist", self.ExchangeName)
+			} else if aerr, ok := err.(*amqp.Error); ok && aerr.Code == amqp.PreconditionFailed && self.AlternateExchange != `` {
+				return nil, fmt.Errorf("cannot declare exchange %q with alternate exchange %q (an existing exchange's arguments cannot be changed): %v", self.ExchangeName, self.AlternateExchange, err)
+			}
+
+			return nil, fmt.Errorf("cannot declare exchange %q: %v", self.ExchangeName, err)
+		}
+
+		self.log().Debugf("declared exchange %q", self.ExchangeName)
+	}
+
+	args, err := self.queueArguments()
+
+	if err != nil {
+		return nil, err
+	}
+
+	keys := self.BindingKeys
+
+	if len(keys) == 0 {
+		if self.RoutingKey != `` {
+			keys = []string{self.RoutingKey}
+		} else if len(self.BindingArguments) > 0 {
+			// headers exchanges ignore the routing key, so bind with an empty one
+			keys = []string{``}
+		}
+	}
+
+	if _, ok := self.BindingArguments[`x-match`]; ok {
+		if kind := sliceutil.OrString(self.ExchangeType, DefaultExchangeType); kind != `headers` {
+			return nil, fmt.Errorf("x-match binding argument requires a headers exchange, but %q is a %s exchange", self.ExchangeName, kind)
+		}
+	}
+
+	if self.TemporaryQueue {
+		if len(self.QueueNames) > 0 {
+			return nil, fmt.Errorf("TemporaryQueue cannot be used with QueueNames")
+		} else if self.Passive {
+			return nil, fmt.Errorf("TemporaryQueue cannot be used with Passive")
+		}
+
+		// fanout exchanges ignore the routing key, but the queue must still be bound to receive anything
+		if len(keys) == 0 {
+			keys = []string{``}
+		}
+	}
+
+	//  declare queues
+	for _, name := range self.queueNames() {
+		durable, autodelete, exclusive := self.Durable, self.Autodelete, self.Exclusive
+
+		if self.TemporaryQueue {
+			durable, autodelete, exclusive = false, true, true
+		}
+
+		queue, err := queueDeclare(
+			name,
+			durable,
+			autodelete,
+			exclusive,
+			false,
+			args,
+		)
+
+		if err != nil {
+			if self.Passive && isNotFound(err) {
+				return nil, fmt.Errorf("queue %q does not exist", name)
+			}
+
+			return nil, err
+		}
+
+		self.log().Debugf("declared queue %q (%d messages, %d consumers)", queue.Name, queue.Messages, queue.Consumers)
+
+		// bind queue to exchange
+		if self.ExchangeName != `` && !self.Passive {
+			for _, key := range keys {
+				if err := channel.QueueBind(queue.Name, key, self.ExchangeName, false, toTable(self.BindingArguments)); err != nil {
+					return nil, fmt.Errorf("cannot bind queue %q to exchange %q: %v", queue.Name, self.ExchangeName, err)
+				}
+			}
+		}
+
+		queues = append(queues, queue)
+	}
+
+	return queues, nil
+}
+
+// the names of all queues to declare and consume from; QueueNames takes precedence over QueueName.
+func (self *AMQP) queueNames() []string {
+	if self.TemporaryQueue {
+		// an empty name asks the broker to generate one
+		return []string{``}
+	} else if len(self.QueueNames) > 0 {
+		return self.QueueNames
+	} else if self.QueueName != `` {
+		return []string{self.QueueName}
+	} else {
+		return nil
+	}
+}
+
+// build the arguments table used when declaring the queue.
+func (self *AMQP) queueArguments() (amqp.Table, error) {
+	args := make(amqp.Table)
+
+	for k, v := range self.Headers {
+		args[k] = v
+	}
+
+	switch qt := strings.ToLower(self.QueueType); qt {
+	case ``, `classic`:
+		if qt != `` {
+			args[`x-queue-type`] = qt
+		}
+	case `quorum`, `stream`:
+		if self.Lazy {
+			return nil, fmt.Errorf("%s queues cannot be declared lazy", qt)
+		} else if !self.Durable {
+			return nil, fmt.Errorf("%s queues must be durable", qt)
+		} else if self.Exclusive {
+			return nil, fmt.Errorf("%s queues cannot be exclusive", qt)
+		} else if self.Autodelete {
+			return nil, fmt.Errorf("%s queues cannot be auto-deleted", qt)
+		}
+
+		args[`x-queue-type`] = qt
+	default:
+		return nil, fmt.Errorf("unsupported queue type %q", self.QueueType)
+	}
+
+	if self.MaxPriority > 0 {
+		if self.MaxPriority > 255 {
+			return nil, fmt.Errorf("MaxPriority must be between 1 and 255, got %d", self.MaxPriority)
+		}
+
+		args[`x-max-priority`] = int32(self.MaxPriority)
+	}
+
+	if self.Lazy {
+		args[`x-queue-mode`] = `lazy`
+	}
+
+	if self.MaxLength > 0 {
+		args[`x-max-length`] = int64(self.MaxLength)
+	}
+
+	if self.MaxLengthBytes > 0 {
+		args[`x-max-length-bytes`] = int64(self.MaxLengthBytes)
+	}
+
+	switch self.Overflow {
+	case ``:
+	case `drop-head`, `reject-publish`, `reject-publish-dlx`:
+		args[`x-overflow`] = self.Overflow
+	default:
+		return nil, fmt.Errorf("unsupported overflow behavior %q: must be drop-head, reject-publish, or reject-publish-dlx", self.Overflow)
+	}
+
+	if self.SingleActiveConsumer {
+		if self.Exclusive {
+			return nil, fmt.Errorf("SingleActiveConsumer cannot be used with Exclusive queues")
+		}
+
+		args[`x-single-active-consumer`] = true
+	}
+
+	if self.DeadLetterExchange != `` {
+		args[`x-dead-letter-exchange`] = self.DeadLetterExchange
+
+		if self.DeadLetterRoutingKey != `` {
+			args[`x-dead-letter-routing-key`] = self.DeadLetterRoutingKey
+		}
+	} else if self.DeadLetterRoutingKey != `` {
+		return nil, fmt.Errorf("DeadLetterRoutingKey requires DeadLetterExchange to be set")
+	}
+
+	return args, nil
+}
+
+// build the arguments to start consuming with, given whether deliveries will be acknowledged
+// automatically.
+func (self *AMQP) consumerArguments(autoAck bool) (amqp.Table, error) {
+	args := make(amqp.Table)
+
+	if self.StrictOrdering && autoAck {
+		return nil, fmt.Errorf("StrictOrdering requires AutoAck to be disabled")
+	}
+
+	for k, v := range self.Headers {
+		args[k] = v
+	}
+
+	if self.isStream() {
+		if autoAck {
+			return nil, fmt.Errorf("consuming from stream queues requires AutoAck to be disabled")
+		}
+
+		if offset := strings.TrimSpace(self.StreamOffset); offset != `` {
+			switch strings.ToLower(offset) {
+			case `first`, `last`, `next`:
+				args[`x-stream-offset`] = strings.ToLower(offset)
+			default:
+				if n, err := strconv.ParseInt(offset, 10, 64); err == nil {
+					args[`x-stream-offset`] = n
+				} else if t, err := time.Parse(time.RFC3339, offset); err == nil {
+					args[`x-stream-offset`] = t
+				} else {
+					return nil, fmt.Errorf("invalid stream offset %q: must be first, last, next, a timestamp, or a number", offset)
+				}
+			}
+		}
+	} else if self.StreamOffset != `` {
+		return nil, fmt.Errorf("StreamOffset requires QueueType to be stream")
+	}
+
+	if self.ConsumerPriority != 0 {
+		args[`x-priority`] = int32(self.ConsumerPriority)
+	}
+
+	return args, nil
+}
+
+func (self *AMQP) isStream() bool {
+	return strings.ToLower(self.QueueType) == `stream`
+}
+
+// the prefetch count to consume with.  StrictOrdering always consumes one message at a time, and
+// stream queues require one to be set, so a default is used if Prefetch is zero.
+func (self *AMQP) prefetch() int {
+	if self.StrictOrdering {
+		return 1
+	} else if self.Prefetch == 0 && self.isStream() {
+		return DefaultStreamPrefetch
+	}
+
+	return self.Prefetch
+}
+
+// establish the AMQP connection, giving up if the context is cancelled before the handshake
+// completes.
+func (self *AMQP) dial(ctx context.Context) (*amqp.Connection, error) {
+	dialer := net.Dialer{
+		Timeout: self.ConnectTimeout,
+	}
+
+	type dialResult struct {
+		conn *amqp.Connection
+		err  error
+	}
+
+	result := make(chan dialResult, 1)
+	auth, err := self.sasl()
+
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := self.tlsConfig()
+
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		conn, err := amqp.DialConfig(self.DialURI(), amqp.Config{
+			TLSClientConfig: tlsConfig,
+			SASL:            auth,
+			// a copy, since the library writes the capabilities it supports into the table
+			Properties: toTable(self.ClientProperties),
+			Heartbeat:  self.HeartbeatInterval,
+			Dial: func(network, addr string) (net.Conn, error) {
+				if self.DialFunc != nil {
+					return self.DialFunc(network, addr)
+				}
+
+				return dialer.DialContext(ctx, network, addr)
+			},
+		})
+
+		result <- dialResult{conn, err}
+	}()
+
+	select {
+	case r := <-result:
+		return r.conn, self.dialError(r.err)
+	case <-ctx.Done():
+		// don't leak a connection that finishes the handshake after we've given up on it
+		go func() {
+			if r := <-result; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+
+		return nil, ctx.Err()
+	}
+}
+
+// explain failures to open the vhost, which the library otherwise reports only as "no access to
+// this vhost" (or, for some brokers, as the connection being closed with NOT_ALLOWED) regardless of
+// which vhost was requested or why access was refused.
+func (self *AMQP) dialError(err error) error {
+	if qerr, ok := err.(*amqp.Error); ok {
+		if qerr == amqp.ErrVhost || (qerr.Code == amqp.NotAllowed && strings.Contains(strings.ToLower(qerr.Reason), `vhost`)) {
+			return fmt.Errorf(
+				"cannot open vhost %q as user %q: check that the vhost exists and that the user has been granted permissions on it (%v)",
+				self.VirtualHost(),
+				self.Username,
+				qerr.Reason,
+			)
+		}
+	}
+
+	return err
+}
+
+// watch for the given channel to close, either surfacing the error or (if AutoReconnect is
+// enabled) reestablishing the connection.
+func (self *AMQP) watch(conn *amqp.Connection, channel *amqp.Channel) {
+	defer self.untrackChannel(channel)
+
+	for qerr := range channel.NotifyClose(make(chan *amqp.Error, 1)) {
+		self.metrics().IncErrors()
+		self.log().Errorf("channel closed: %v", qerr)
+
+		if fn := self.OnChannelClose; fn != nil {
+			go fn(qerr)
+		}
+
+		if self.AutoReconnect && !self.isClosing() {
+			self.reconnect(conn)
+			return
+		}
+
+		self.errchan <- closeError(qerr)
+	}
+}
+
+// convert the reason a channel was closed into an error.  Failures to read from the underlying
+// socket are reported by the library as frame errors; those caused by the read deadline expiring
+// mean the broker's heartbeats stopped arriving, while any others (e.g.: the connection being
+// reset) mean the connection was lost some other way.
+func closeError(qerr *amqp.Error) error {
+	if !qerr.Server && qerr.Code == amqp.FrameError {
+		if strings.Contains(qerr.Reason, `timeout`) {
+			return ErrHeartbeatTimeout
+		} else {
+			return ErrConnectionLost
+		}
+	} else if qerr.Server {
+		return fmt.Errorf("server error %d: %v", qerr.Code, qerr.Reason)
+	} else {
+		return fmt.Errorf("client error %d: %v", qerr.Code, qerr.Reason)
+	}
+}
+
+// relay the reason the given connection was closed to OnConnClose.
+func (self *AMQP) watchConnClose(conn *amqp.Connection) {
+	for qerr := range conn.NotifyClose(make(chan *amqp.Error, 1)) {
+		if fn := self.OnConnClose; fn != nil {
+			go fn(qerr)
+		}
+	}
+}
+
+// watch for the broker to tell us to stop publishing (e.g.: because of a low memory or disk space
+// alarm) and relay those notifications to the caller.
+func (self *AMQP) watchBlocked(conn *amqp.Connection) {
+	for blocking := range conn.NotifyBlocked(make(chan amqp.Blocking, 1)) {
+		self.stateLock.Lock()
+		self.setBlocked(blocking.Active)
+		self.stateLock.Unlock()
+
+		if blocking.Active {
+			self.log().Warnf("connection blocked by broker: %s", blocking.Reason)
+		} else {
+			self.log().Warnf("connection unblocked")
+		}
+
+		select {
+		case self.blockedchan <- blocking:
+		default:
+		}
+	}
+}
+
+// watch for messages the broker could not route (when published with Mandatory or Immediate set)
+// and relay them to the caller.
+func (self *AMQP) watchReturns(channel *amqp.Channel) {
+	for r := range channel.NotifyReturn(make(chan amqp.Return, 1)) {
+		message := self.messageFromDelivery(channel, ``, amqp.Delivery{
+			Exchange:        r.Exchange,
+			RoutingKey:      r.RoutingKey,
+			ContentType:     r.ContentType,
+			ContentEncoding: r.ContentEncoding,
+			Headers:         r.Headers,
+			DeliveryMode:    r.DeliveryMode,
+			Priority:        r.Priority,
+			CorrelationId:   r.CorrelationId,
+			ReplyTo:         r.ReplyTo,
+			Expiration:      r.Expiration,
+			MessageId:       r.MessageId,
+			Timestamp:       r.Timestamp,
+			Type:            r.Type,
+			UserId:          r.UserId,
+			AppId:           r.AppId,
+			Body:            r.Body,
+		}, true)
+
+		message.ReturnCode = int(r.ReplyCode)
+		message.ReturnReason = r.ReplyText
+
+		self.log().Warnf("message %s returned by broker: %d %s", message.ID(), r.ReplyCode, r.ReplyText)
+
+		select {
+		case self.returnchan <- message:
+		default:
+			self.log().Errorf("dropped returned message %s: no receiver", message.ID())
+		}
+	}
+}
+
+// watch for the broker to pause and resume deliveries of published messages on the channel (via
+// channel.flow), holding publishers while it is paused.
+func (self *AMQP) watchFlow(channel *amqp.Channel) {
+	for active := range channel.NotifyFlow(make(chan bool, 1)) {
+		self.stateLock.Lock()
+		self.setFlow(active)
+		self.stateLock.Unlock()
+
+		if active {
+			self.log().Infof("flow resumed by broker")
+		} else {
+			self.log().Warnf("flow paused by broker")
+		}
+	}
+
+	// the channel is gone, so release anyone waiting on it; they'll wait for a reconnect instead
+	self.stateLock.Lock()
+	self.setFlow(true)
+	self.stateLock.Unlock()
+}
+
+// watch for the broker cancelling our consumers (e.g.: because their queue was deleted, or the
+// node hosting it failed).  The affected delivery loops restart their consumers themselves if
+// AutoReconnect is enabled; this just relays the notification.
+func (self *AMQP) watchCancels(channel *amqp.Channel) {
+	for tag := range channel.NotifyCancel(make(chan string, 1)) {
+		self.log().Warnf("consumer %q cancelled by broker", tag)
+
+		select {
+		case self.cancelchan <- tag:
+		default:
+		}
+	}
+}
+
+// record whether the broker wants publishing to be active.  Must be called with stateLock held.
+func (self *AMQP) setFlow(active bool) {
+	if !active && self.flowPaused == nil {
+		self.flowPaused = make(chan struct{})
+	} else if active && self.flowPaused != nil {
+		close(self.flowPaused)
+		self.flowPaused = nil
+	}
+}
+
+// Return whether the broker currently allows publishing on the channel.  While it doesn't,
+// publishes wait (up to PublishTimeout, if set) for it to be allowed again.
+func (self *AMQP) FlowActive() bool {
+	self.stateLock.RLock()
+	defer self.stateLock.RUnlock()
+
+	return self.flowPaused == nil
+}
+
+// record whether the broker has blocked the connection; publishers waiting for it to be unblocked
+// are released when it is.  Must be called with stateLock held.
+func (self *AMQP) setBlocked(blocked bool) {
+	if blocked && self.unblocked == nil {
+		self.unblocked = make(chan struct{})
+	} else if !blocked && self.unblocked != nil {
+		close(self.unblocked)
+		self.unblocked = nil
+	}
+}
+
+// wait for the broker to unblock the connection, if it is blocked.
+func (self *AMQP) waitUnblocked(ctx context.Context) error {
+	self.stateLock.RLock()
+	unblocked := self.unblocked
+	self.stateLock.RUnlock()
+
+	if unblocked != nil {
+		select {
+		case <-unblocked:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// wait for the broker to resume flow on the channel, if it is paused.
+func (self *AMQP) waitFlow(ctx context.Context) error {
+	self.stateLock.RLock()
+	paused := self.flowPaused
+	self.stateLock.RUnlock()
+
+	if paused != nil {
+		select {
+		case <-paused:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// tear down the given connection and repeatedly attempt to connect again, waiting an
+// exponentially-increasing amount of time between attempts.
+func (self *AMQP) reconnect(previous *amqp.Connection) {
+	self.stateLock.Lock()
+	self.ready = make(chan struct{})
+	self.channel = nil
+	self.confirms = nil
+	self.stateLock.Unlock()
+
+	previous.Close()
+	self.log().Warnf("connection lost, reconnecting")
+
+	backoff := self.backoff()
+	delay := backoff.Min
+	reconnected := false
+
+	for !self.isClosing() {
+		if err := self.connect(context.Background()); err == nil {
+			reconnected = true
+			break
+		} else {
+			self.log().Errorf("reconnect failed, retrying in %v: %v", delay, err)
+		}
+
+		time.Sleep(delay)
+
+		if delay *= 2; delay > backoff.Max {
+			delay = backoff.Max
+		}
+	}
+
+	self.stateLock.Lock()
+	close(self.ready)
+	self.ready = nil
+	self.stateLock.Unlock()
+
+	if reconnected {
+		self.log().Infof("reconnected to %s", self.SafeURI())
+
+		select {
+		case self.reconnectchan <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// generate a consumer tag that is unique to this host and process, in the form
+// "<prefix>-<hostname>-<pid>-<random>".
+func (self *AMQP) generateConsumerTag() string {
+	hostname, _ := os.Hostname()
+
+	return fmt.Sprintf(
+		"%s-%s-%d-%s",
+		sliceutil.OrString(self.ConsumerTagPrefix, DefaultConsumerTagPrefix),
+		sliceutil.OrString(hostname, `unknown`),
+		os.Getpid(),
+		stringutil.UUID().String()[0:8],
+	)
+}
+
+func (self *AMQP) backoff() Backoff {
+	backoff := self.ReconnectBackoff
+
+	if backoff.Min <= 0 {
+		backoff.Min = DefaultReconnectBackoff.Min
+	}
+
+	if backoff.Max < backoff.Min {
+		backoff.Max = backoff.Min
+	}
+
+	return backoff
+}
+
+// Return whether the client currently has a usable channel to the broker.
+func (self *AMQP) Connected() bool {
+	self.stateLock.RLock()
+	defer self.stateLock.RUnlock()
+
+	return self.channel != nil && self.ready == nil
+}
+
+// Wait up to the given timeout for the client to have a usable channel to the broker, e.g.: for
+// an in-progress reconnect to complete, or for a Connect running in another goroutine to finish.
+// Returns ErrNotConnected if the timeout elapses first, or if the client has been closed.
+func (self *AMQP) WaitReady(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for !self.isClosing() {
+		if _, err := self.channelReady(ctx); err == nil {
+			return nil
+		} else if err != ErrNotConnected {
+			break
+		}
+
+		select {
+		case <-time.After(50 * time.Millisecond):
+		case <-ctx.Done():
+			return ErrNotConnected
+		}
+	}
+
+	return ErrNotConnected
+}
+
+// Return the maximum frame size negotiated with the broker, in bytes, or zero if not connected.
+// Message bodies larger than this are sent as several frames.
+func (self *AMQP) FrameMax() int {
+	self.stateLock.RLock()
+	defer self.stateLock.RUnlock()
+
+	if self.conn == nil {
+		return 0
+	}
+
+	return self.conn.Config.FrameSize
+}
+
+// Return the maximum number of channels negotiated with the broker, or zero if not connected.
+func (self *AMQP) ChannelMax() int {
+	self.stateLock.RLock()
+	defer self.stateLock.RUnlock()
+
+	if self.conn == nil {
+		return 0
+	}
+
+	return self.conn.Config.ChannelMax
+}
+
+func (self *AMQP) isClosing() bool {
+	self.stateLock.RLock()
+	defer self.stateLock.RUnlock()
+
+	return self.closing
+}
+
+// retrieve the current channel, blocking until any in-progress reconnect has completed or the
+// context is cancelled.
+func (self *AMQP) channelReady(ctx context.Context) (*amqp.Channel, error) {
+	for {
+		self.stateLock.RLock()
+		channel, ready := self.channel, self.ready
+		self.stateLock.RUnlock()
+
+		if ready != nil {
+			select {
+			case <-ready:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		} else if channel == nil {
+			return nil, ErrNotConnected
+		} else {
+			return channel, nil
+		}
+	}
+}
+
+// open a new, short-lived channel on the current connection.  This is used for operations that
+// might cause the broker to close the channel they are performed on (e.g.: passive declarations
+// of things that don't exist).
+func (self *AMQP) temporaryChannel() (*amqp.Channel, error) {
+	return self.openChannel(context.Background())
+}
+
+func (self *AMQP) SubscribeRaw() (<-chan amqp.Delivery, error) {
+	self.stateLock.RLock()
+	queue := self.queue.Name
+	self.stateLock.RUnlock()
+
+	_, msgs, err := self.consume(context.Background(), queue, self.ID)
+	return msgs, err
+}
+
+func (self *AMQP) consume(ctx context.Context, queue string, tag string) (*amqp.Channel, <-chan amqp.Delivery, error) {
+	args, err := self.consumerArguments(self.AutoAck)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if channel, err := self.channelReady(ctx); err == nil {
+		msgs, err := channel.Consume(
+			queue,
+			tag,
+			self.AutoAck,
+			self.Exclusive,
+			self.NoLocal,
+			false,
+			args,
+		)
+
+		return channel, msgs, err
+	} else {
+		return nil, nil, err
+	}
+}
+
+// wait for an in-progress reconnect to complete, then restart consuming on the new channel.
+func (self *AMQP) resubscribe(ctx context.Context, queue string, tag string) (*amqp.Channel, string, <-chan amqp.Delivery) {
+	for self.AutoReconnect && !self.isClosing() && ctx.Err() == nil {
+		if self.TemporaryQueue {
+			// the old queue went away with the old connection, and the new one has a different name
+			if _, err := self.channelReady(ctx); err == nil {
+				self.stateLock.RLock()
+				queue = self.queue.Name
+				self.stateLock.RUnlock()
+			}
+		}
+
+		if channel, msgs, err := self.consume(ctx, queue, tag); err == nil {
+			return channel, queue, msgs
+		}
+
+		select {
+		case <-time.After(self.backoff().Min):
+		case <-ctx.Done():
+		}
+	}
+
+	return nil, queue, nil
+}
+
+// Publish messages read from the given reader, separated by newlines ("\n").  When Confirms is
+// enabled, lines are published in batches (see PublishBatch).
+func (self *AMQP) PublishLines(reader io.Reader, header MessageHeader) error {
+	return self.publishLines(reader, fixedHeader(header), nil)
+}
+
+// Publish messages read from the given reader, separated by newlines ("\n"), with each message's
+// header given by calling headerFn with its line (e.g.: to make some messages persistent, or to
+// set their priority, based on their contents).  The line is only valid until headerFn returns.
+// Otherwise this behaves like PublishLines.
+func (self *AMQP) PublishLinesFunc(reader io.Reader, headerFn func(line []byte) MessageHeader) error {
+	if headerFn == nil {
+		return fmt.Errorf("no header function given")
+	}
+
+	return self.publishLines(reader, headerFn, nil)
+}
+
+func fixedHeader(header MessageHeader) func([]byte) MessageHeader {
+	return func([]byte) MessageHeader {
+		return header
+	}
+}
+
+// Publish messages read from the given reader, where each line is a JSON document (i.e.: JSON
+// Lines).  Every line is validated before it is published, and the ContentType of each message is
+// set to application/json.  Blank lines are skipped.  Publishing stops at the first line that is
+// not valid JSON, returning an error that includes its line number.
+func (self *AMQP) PublishJSONLines(reader io.Reader, header MessageHeader) error {
+	header.ContentType = `application/json`
+
+	return self.publishLines(reader, fixedHeader(header), func(lineno int, line []byte) (bool, error) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			return false, nil
+		} else if !json.Valid(line) {
+			return false, fmt.Errorf("line %d is not valid JSON", lineno)
+		}
+
+		return true, nil
+	})
+}
+
+// publish each line read from the reader, with the header headerFn returns for it.  If given, the
+// filter is called with every line and its (1-based) line number, and decides whether the line
+// should be published or an error returned.
+func (self *AMQP) publishLines(reader io.Reader, headerFn func([]byte) MessageHeader, filter func(int, []byte) (bool, error)) error {
+	if _, err := self.channelReady(context.Background()); err != nil {
+		return err
+	}
+
+	inScanner := bufio.NewScanner(reader)
+	lineno := 0
+
+	next := func() ([]byte, MessageHeader, bool, error) {
+		for inScanner.Scan() {
+			lineno += 1
+
+			if size := len(inScanner.Bytes()); self.MaxMessageBytes > 0 && size > self.MaxMessageBytes {
+				if self.SkipOversized {
+					self.log().Warnf("skipping line %d: %d bytes exceeds the maximum of %d", lineno, size, self.MaxMessageBytes)
+					continue
+				} else {
+					return nil, MessageHeader{}, false, fmt.Errorf("line %d is %d bytes, exceeding the maximum of %d", lineno, size, self.MaxMessageBytes)
+				}
+			}
+
+			if filter != nil {
+				if ok, err := filter(lineno, inScanner.Bytes()); err != nil {
+					return nil, MessageHeader{}, false, err
+				} else if !ok {
+					continue
+				}
+			}
+
+			return inScanner.Bytes(), headerFn(inScanner.Bytes()), true, nil
+		}
+
+		return nil, MessageHeader{}, false, nil
+	}
+
+	if self.Confirms {
+		batch := make([][]byte, 0)
+		headers := make([]MessageHeader, 0)
+
+		flush := func() error {
+			err := self.publishBatch(batch, func(i int) MessageHeader {
+				return headers[i]
+			})
+
+			batch = batch[:0]
+			headers = headers[:0]
+
+			return err
+		}
+
+		for {
+			line, header, ok, err := next()
+
+			if err != nil {
+				// lines before the bad one are published, same as when confirms are disabled
+				if len(batch) > 0 {
+					if perr := flush(); perr != nil {
+						return perr
+					}
+				}
+
+				return err
+			} else if !ok {
+				break
+			}
+
+			batch = append(batch, append([]byte(nil), line...))
+			headers = append(headers, header)
+
+			if len(batch) >= self.BatchWindow {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+
+		if len(batch) > 0 {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	} else {
+		for {
+			line, header, ok, err := next()
+
+			if err != nil {
+				return err
+			} else if !ok {
+				break
+			}
+
+			if err := self.Publish(line, header); err != nil {
+				return err
+			}
+		}
+	}
+
+	return inScanner.Err()
+}
+
+// Publish a single message.  The body may be empty (e.g.: for messages used as signals).  When
+// Confirms is enabled, this does not wait for the broker to confirm the message; call Flush to
+// wait for all outstanding confirmations at once, or use PublishConfirm to wait for each one.
+func (self *AMQP) Publish(data []byte, header MessageHeader) error {
+	return self.PublishContext(context.Background(), data, header)
+}
+
+// Publish a single message, giving up if the context is cancelled before it can be sent.
+func (self *AMQP) PublishContext(ctx context.Context, data []byte, header MessageHeader) error {
+	if msg, err := self.publishing(data, header); err == nil {
+		_, _, err := self.publish(ctx, msg, false)
+		return err
+	} else {
+		return err
+	}
+}
+
+// Wait up to the given timeout for the broker to confirm every message published with Publish (or
+// PublishLines) since the last Flush.  The returned error lists the delivery tags of any messages
+// the broker rejected, or that were lost because the channel closed before they were confirmed.
+// Only messages published on the current channel are covered; confirmations outstanding when the
+// connection was lost cannot be recovered.  Requires Confirms to be enabled.
+func (self *AMQP) Flush(timeout time.Duration) error {
+	if !self.Confirms {
+		return fmt.Errorf("publisher confirms are not enabled")
+	}
+
+	if _, err := self.channelReady(context.Background()); err != nil {
+		return err
+	}
+
+	self.stateLock.RLock()
+	confirms := self.confirms
+	self.stateLock.RUnlock()
+
+	if confirms == nil {
+		return ErrNotConnected
+	}
+
+	return confirms.flush(timeout)
+}
+
+// Publish a single message and wait for the broker to confirm that it has taken responsibility
+// for it.  Requires Confirms to be enabled.
+func (self *AMQP) PublishConfirm(data []byte, header MessageHeader) error {
+	if !self.Confirms {
+		return fmt.Errorf("publisher confirms are not enabled")
+	}
+
+	ctx := context.Background()
+
+	if msg, err := self.publishing(data, header); err == nil {
+		if tag, ack, err := self.publish(ctx, msg, true); err == nil {
+			return self.waitConfirm(ctx, tag, ack)
+		} else {
+			return err
+		}
+	} else {
+		return err
+	}
+}
+
+func (self *AMQP) requeueAfter(message *Message, delay time.Duration) error {
+	if self.DelayExchange == `` {
+		return fmt.Errorf("no delay exchange is configured")
+	}
+
+	return self.republish(message, self.DelayExchange, func(header *MessageHeader) {
+		header.Headers[`x-delay`] = int64(delay / time.Millisecond)
+	})
+}
+
+func (self *AMQP) requeueModified(message *Message, modify func(*MessageHeader)) error {
+	return self.republish(message, message.delivery.Exchange, modify)
+}
+
+// publish a copy of a received message to the given exchange with its original routing key, after
+// letting modify change a copy of its header, then acknowledge the original.  The body is
+// republished exactly as it was received (so any compression is preserved), as is its timestamp.
+func (self *AMQP) republish(message *Message, exchange string, modify func(*MessageHeader)) error {
+	if !message.ShouldAck() {
+		return fmt.Errorf("message %s does not require acknowledgement", message.ID())
+	}
+
+	ctx := context.Background()
+	delivery := message.delivery
+	header := message.Header
+	header.Headers = make(map[string]interface{}, len(message.Header.Headers))
+
+	// a copy, so the original message is unaffected by anything modify does
+	for k, v := range message.Header.Headers {
+		header.Headers[k] = v
+	}
+
+	if modify != nil {
+		modify(&header)
+	}
+
+	msg, err := self.publishing(delivery.Body, header)
+
+	if err != nil {
+		return err
+	}
+
+	// undo any compression publishing applied to a body that was received uncompressed
+	msg.Body = delivery.Body
+	msg.ContentEncoding = header.ContentEncoding
+	msg.Timestamp = delivery.Timestamp
+
+	if tag, ack, err := self.publishTo(ctx, exchange, delivery.RoutingKey, msg, self.Confirms); err == nil {
+		if self.Confirms {
+			if err := self.waitConfirm(ctx, tag, ack); err != nil {
+				return err
+			}
+		}
+	} else {
+		return fmt.Errorf("cannot republish message %s to exchange %q: %v", message.ID(), exchange, err)
+	}
+
+	return message.Acknowledge()
+}
+
+// Republish previously-received messages (e.g.: ones captured to a file and read back with
+// Message.UnmarshalJSON), waiting between each one for as long as passed between their original
+// timestamps, so as to reproduce the timing of the original traffic.  See ReplaySpeed and
+// ReplayMaxDelay.  Messages with no timestamp, or one earlier than the message before, are
+// published immediately.
+func (self *AMQP) ReplayTimed(messages []*Message) error {
+	speed := self.ReplaySpeed
+
+	if speed <= 0 {
+		speed = 1
+	}
+
+	var last time.Time
+
+	for i, message := range messages {
+		if !last.IsZero() && message.Timestamp.After(last) {
+			delay := time.Duration(float64(message.Timestamp.Sub(last)) / speed)
+
+			if self.ReplayMaxDelay > 0 && delay > self.ReplayMaxDelay {
+				delay = self.ReplayMaxDelay
+			}
+
+			time.Sleep(delay)
+		}
+
+		if !message.Timestamp.IsZero() {
+			last = message.Timestamp
+		}
+
+		if err := self.Publish(message.Body, message.Header); err != nil {
+			return fmt.Errorf("cannot replay message %d: %v", i, err)
+		}
+	}
+
+	return nil
+}
+
+// Publish several messages with the same header.  When Confirms is enabled, messages are
+// published in windows of up to BatchWindow messages at a time, and all confirmations for a window
+// are collected before the next one is published.  Messages the broker rejects are reported by
+// their index in the batch.
+func (self *AMQP) PublishBatch(messages [][]byte, header MessageHeader) error {
+	return self.publishBatch(messages, func(int) MessageHeader {
+		return header
+	})
+}
+
+// publish several messages, with the header for each given by its index in the batch.
+func (self *AMQP) publishBatch(messages [][]byte, headerFor func(int) MessageHeader) error {
+	type pendingConfirm struct {
+		index int
+		tag   uint64
+		ack   <-chan bool
+	}
+
+	var merr error
+	ctx := context.Background()
+	window := self.BatchWindow
+
+	if window <= 0 {
+		window = DefaultBatchWindow
+	}
+
+	for start := 0; start < len(messages); start += window {
+		end := start + window
+
+		if end > len(messages) {
+			end = len(messages)
+		}
+
+		pending := make([]pendingConfirm, 0, end-start)
+
+		for i := start; i < end; i++ {
+			if msg, err := self.publishing(messages[i], headerFor(i)); err == nil {
+				if tag, ack, err := self.publish(ctx, msg, self.Confirms); err == nil {
+					if ack != nil {
+						pending = append(pending, pendingConfirm{i, tag, ack})
+					}
+				} else {
+					return utils.AppendError(merr, fmt.Errorf("message %d: %v", i, err))
+				}
+			} else {
+				return utils.AppendError(merr, fmt.Errorf("message %d: %v", i, err))
+			}
+		}
+
+		for _, p := range pending {
+			if err := self.waitConfirm(ctx, p.tag, p.ack); err != nil {
+				merr = utils.AppendError(merr, fmt.Errorf("message %d: %v", p.index, err))
+			}
+		}
+	}
+
+	return merr
+}
+
+// the codec published bodies should be compressed with, or an empty string if compression is off.
+// Setting CompressPublish without naming a codec implies gzip.
+func (self *AMQP) compressCodec() string {
+	if self.CompressCodec != `` {
+		return self.CompressCodec
+	} else if self.CompressPublish {
+		return `gzip`
+	}
+
+	return ``
+}
+
+func (self *AMQP) publishing(data []byte, header MessageHeader) (amqp.Publishing, error) {
+	var deliveryMode int
+
+	if self.MaxMessageBytes > 0 && len(data) > self.MaxMessageBytes {
+		return amqp.Publishing{}, fmt.Errorf("message body is %d bytes, exceeding the maximum of %d", len(data), self.MaxMessageBytes)
+	}
+
+	if self.MaxPriority > 0 && header.Priority > self.MaxPriority {
+		return amqp.Publishing{}, fmt.Errorf("message priority %d exceeds the queue's maximum priority of %d", header.Priority, self.MaxPriority)
+	}
+
+	if self.SniffContentType && header.ContentType == `` && header.ContentEncoding == `` && len(data) > 0 {
+		header.ContentType = sniffContentType(data)
+	}
+
+	switch header.DeliveryMode {
+	case Transient:
+		deliveryMode = 1
+	case Persistent:
+		deliveryMode = 2
+	}
+
+	pubOpts := amqp.Publishing{
+		Body:            data,
+		ContentType:     header.ContentType,
+		ContentEncoding: header.ContentEncoding,
+		DeliveryMode:    uint8(deliveryMode),
+		Priority:        uint8(header.Priority),
+		Timestamp:       time.Now(),
+		Headers:         toTable(header.Headers),
+		CorrelationId:   header.CorrelationId,
+		ReplyTo:         header.ReplyTo,
+		AppId:           header.AppId,
+		UserId:          header.UserId,
+		Type:            header.Type,
+		MessageId: sliceutil.OrString(
+			header.ID,
+			stringutil.UUID().String(),
+		),
+	}
+
+	// bodies that already declare an encoding are assumed to have been compressed by the caller
+	if codec := self.compressCodec(); codec != `` && header.ContentEncoding == `` && len(data) > 0 && len(data) >= self.CompressMinBytes {
+		if compressed, err := compress(codec, data); err == nil {
+			pubOpts.Body = compressed
+			pubOpts.ContentEncoding = normalizeEncoding(codec)
+		} else {
+			return amqp.Publishing{}, err
+		}
+	}
+
+	expiration := header.Expiration
+
+	// an absolute expiration is converted to the time remaining, and wins if it is sooner
+	if !header.ExpiresAt.IsZero() {
+		remaining := time.Until(header.ExpiresAt)
+
+		if remaining <= 0 {
+			return amqp.Publishing{}, fmt.Errorf("message already expired at %v", header.ExpiresAt)
+		} else if remaining < time.Millisecond {
+			remaining = time.Millisecond
+		}
+
+		if expiration <= 0 || remaining < expiration {
+			expiration = remaining
+		}
+	}
+
+	if expiration > 0 {
+		pubOpts.Expiration = fmt.Sprintf("%d", int(
+			expiration.Round(time.Millisecond)/time.Millisecond,
+		))
+	}
+
+	return pubOpts, nil
+}
+
+// convert a map of native Go values into an amqp.Table, coercing values the AMQP wire format
+// cannot represent (e.g.: int, uint, nested maps) into types it can.
+func toTable(in map[string]interface{}) amqp.Table {
+	if in == nil {
+		return nil
+	}
+
+	out := make(amqp.Table, len(in))
+
+	for k, v := range in {
+		out[k] = toFieldValue(v)
+	}
+
+	return out
+}
+
+func toFieldValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int:
+		return int64(v)
+	case int8:
+		return int16(v)
+	case uint:
+		return int64(v)
+	case uint16:
+		return int32(v)
+	case uint32:
+		return int64(v)
+	case uint64:
+		return int64(v)
+	case map[string]interface{}:
+		return toTable(v)
+	case amqp.Table:
+		return toTable(v)
+	case []string:
+		out := make([]interface{}, len(v))
+
+		for i, item := range v {
+			out[i] = item
+		}
+
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+
+		for i, item := range v {
+			out[i] = toFieldValue(item)
+		}
+
+		return out
+	default:
+		return v
+	}
+}
+
+// publish the given message on the current channel.  When the channel is in confirm mode, the
+// delivery tag assigned to it is returned, along with a channel to wait on for the broker's
+// confirmation (if wait is true).
+func (self *AMQP) publish(ctx context.Context, msg amqp.Publishing, wait bool) (uint64, <-chan bool, error) {
+	return self.publishTo(ctx, self.ExchangeName, self.RoutingKey, msg, wait)
+}
+
+// publish a message to the given exchange.  If PublishTimeout is set, the whole operation
+// (including waiting for the connection to become ready or be unblocked) must complete within it,
+// otherwise ErrPublishTimeout is returned.
+func (self *AMQP) publishTo(ctx context.Context, exchange string, key string, msg amqp.Publishing, wait bool) (uint64, <-chan bool, error) {
+	return self.publishVia(ctx, self.currentChannel, self.waitFlow, exchange, key, msg, wait)
+}
+
+// returns the channel to publish on, along with its confirmation tracker if confirms are enabled.
+type channelOpener func(context.Context) (*amqp.Channel, *confirmTracker, error)
+
+// the client's channel and its confirmation tracker, once any in-progress reconnect has completed.
+func (self *AMQP) currentChannel(ctx context.Context) (*amqp.Channel, *confirmTracker, error) {
+	if channel, err := self.channelReady(ctx); err == nil {
+		self.stateLock.RLock()
+		confirms := self.confirms
+		self.stateLock.RUnlock()
+
+		return channel, confirms, nil
+	} else {
+		return nil, nil, err
+	}
+}
+
+// publish a message on the channel returned by open, once waitFlow says the broker allows
+// publishing on it.  This is shared by the client and Publishers, so that PublishRate,
+// PublishTimeout, and connection blocking apply to both alike.
+func (self *AMQP) publishVia(ctx context.Context, open channelOpener, waitFlow func(context.Context) error, exchange string, key string, msg amqp.Publishing, wait bool) (uint64, <-chan bool, error) {
+	if self.PublishTimeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, self.PublishTimeout)
+		defer cancel()
+
+		tag, ack, err := self.publishWithin(ctx, open, waitFlow, exchange, key, msg, wait)
+
+		if err == context.DeadlineExceeded {
+			err = ErrPublishTimeout
+		}
+
+		return tag, ack, err
+	} else {
+		return self.publishWithin(ctx, open, waitFlow, exchange, key, msg, wait)
+	}
+}
+
+func (self *AMQP) publishWithin(ctx context.Context, open channelOpener, waitFlow func(context.Context) error, exchange string, key string, msg amqp.Publishing, wait bool) (uint64, <-chan bool, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	if self.PublishRate > 0 {
+		if err := self.limiter.wait(ctx, self.PublishRate); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	// without a timeout, publishes go out as soon as possible and stall in the broker instead
+	if self.PublishTimeout > 0 {
+		if err := self.waitUnblocked(ctx); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	if err := waitFlow(ctx); err != nil {
+		return 0, nil, err
+	}
+
+	if channel, confirms, err := open(ctx); err == nil {
+		publishFn := func() error {
+			return channel.Publish(exchange, key, self.Mandatory, self.Immediate, msg)
+		}
+
+		var tag uint64
+		var ack <-chan bool
+		started := time.Now()
+
+		send := func() {
+			if confirms != nil {
+				tag, ack, err = confirms.publish(publishFn, wait)
+			} else {
+				err = publishFn()
+			}
+		}
+
+		if self.PublishTimeout > 0 {
+			done := make(chan struct{})
+
+			// the write can't be interrupted, so it is left to finish in the background if it
+			// takes too long (keeping the confirmation sequence in step with the broker's).
+			go func() {
+				send()
+				close(done)
+			}()
+
+			select {
+			case <-done:
+			case <-ctx.Done():
+				self.metrics().IncErrors()
+				return 0, nil, ctx.Err()
+			}
+		} else {
+			send()
+		}
+
+		if err == nil {
+			self.countPublished()
+			self.metrics().ObservePublishLatency(time.Since(started))
+		} else {
+			self.metrics().IncErrors()
+		}
+
+		return tag, ack, err
+	} else {
+		return 0, nil, err
+	}
+}
+
+func (self *AMQP) waitConfirm(ctx context.Context, tag uint64, ack <-chan bool) error {
+	timeout := self.ConfirmTimeout
+
+	if timeout <= 0 {
+		timeout = DefaultConfirmTimeout
+	}
+
+	select {
+	case ok, open := <-ack:
+		if !open {
+			return fmt.Errorf("channel closed before message %d was confirmed", tag)
+		} else if !ok {
+			return fmt.Errorf("broker rejected message %d", tag)
+		} else {
+			return nil
+		}
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out waiting for confirmation of message %d", tag)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Publish a single message serialized as JSON.  The Content-Type header defaults to
+// "application/json" if not already set, and serialization errors are returned without
+// publishing anything.
+func (self *AMQP) PublishJSON(body interface{}, header MessageHeader) error {
+	if data, err := json.Marshal(body); err == nil {
+		if header.ContentType == `` {
+			header.ContentType = `application/json`
+		}
+
+		return self.Publish(data, header)
+	} else {
+		return fmt.Errorf("serialization error: %v", err)
+	}
+}
+
+// Publish a message to every queue bound to the named fanout exchange.  Fanout exchanges ignore
+// routing keys, so the message is published with an empty one regardless of RoutingKey.  The
+// exchange is verified to exist the first time it is published to on a connection, or declared if
+// DeclareFanouts is set (and Passive is not).
+func (self *AMQP) PublishFanout(exchange string, data []byte, header MessageHeader) error {
+	if exchange == `` {
+		return fmt.Errorf("no exchange given")
+	} else if exchange == self.ExchangeName {
+		if kind := sliceutil.OrString(self.ExchangeType, DefaultExchangeType); kind != `fanout` {
+			return fmt.Errorf("exchange %q is a %s exchange, not fanout", exchange, kind)
+		}
+	}
+
+	if err := self.declareFanout(exchange); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	if msg, err := self.publishing(data, header); err == nil {
+		if tag, ack, err := self.publishTo(ctx, exchange, ``, msg, self.Confirms); err == nil {
+			if self.Confirms {
+				return self.waitConfirm(ctx, tag, ack)
+			}
+
+			return nil
+		} else {
+			return err
+		}
+	} else {
+		return err
+	}
+}
+
+// Publish a message directly to the named queue, via the default exchange (which routes every
+// message to the queue named by its routing key), regardless of ExchangeName and RoutingKey.  As
+// with Publish, this does not wait for a confirmation.  Messages for queues that don't exist are
+// silently dropped by the broker unless Mandatory is set (see NotifyReturn).
+func (self *AMQP) PublishToQueue(queue string, data []byte, header MessageHeader) error {
+	if queue == `` {
+		return fmt.Errorf("no queue given")
+	}
+
+	if msg, err := self.publishing(data, header); err == nil {
+		_, _, err := self.publishTo(context.Background(), ``, queue, msg, false)
+		return err
+	} else {
+		return err
+	}
+}
+
+func (self *AMQP) declareFanout(exchange string) error {
+	self.stateLock.RLock()
+	declared := self.fanouts[exchange]
+	self.stateLock.RUnlock()
+
+	if declared {
+		return nil
+	}
+
+	// a failed declaration closes the channel it was made on, so use one we can throw away
+	if channel, err := self.temporaryChannel(); err == nil {
+		defer channel.Close()
+
+		passive := self.Passive || !self.DeclareFanouts
+
+		if passive {
+			err = channel.ExchangeDeclarePassive(exchange, `fanout`, false, false, false, false, nil)
+		} else {
+			err = channel.ExchangeDeclare(exchange, `fanout`, self.ExchangeDurable, self.ExchangeAutodelete, false, false, nil)
+		}
+
+		if err != nil {
+			if passive && isNotFound(err) {
+				return fmt.Errorf("exchange %q does not exist", exchange)
+			}
+
+			return fmt.Errorf("cannot declare exchange %q: %v", exchange, err)
+		}
+	} else {
+		return err
+	}
+
+	self.stateLock.Lock()
+	defer self.stateLock.Unlock()
+
+	if self.fanouts == nil {
+		self.fanouts = make(map[string]bool)
+	}
+
+	self.fanouts[exchange] = true
+
+	return nil
+}
+
+// Publish a message as a request and wait for a reply.  An exclusive reply queue is declared for
+// the duration of the call, and the published message's ReplyTo and CorrelationId headers are set
+// so the responder knows where to send its reply.  Replies with a CorrelationId that does not
+// match the request are discarded.
+func (self *AMQP) Call(data []byte, header MessageHeader, timeout time.Duration) (*Message, error) {
+	ctx := context.Background()
+
+	if channel, err := self.channelReady(ctx); err == nil {
+		replyQueue, err := channel.QueueDeclare(``, false, true, true, false, nil)
+
+		if err != nil {
+			return nil, fmt.Errorf("cannot declare reply queue: %v", err)
+		}
+
+		tag := self.generateConsumerTag()
+		replies, err := channel.Consume(replyQueue.Name, tag, true, true, false, false, nil)
+
+		if err != nil {
+			return nil, fmt.Errorf("cannot consume from reply queue: %v", err)
+		}
+
+		defer channel.Cancel(tag, false)
+
+		header.ReplyTo = replyQueue.Name
+		header.CorrelationId = sliceutil.OrString(header.CorrelationId, stringutil.UUID().String())
+
+		if msg, err := self.publishing(data, header); err == nil {
+			if _, _, err := self.publish(ctx, msg, false); err != nil {
+				return nil, err
+			}
+		} else {
+			return nil, err
+		}
+
+		deadline := time.After(timeout)
+
+		for {
+			select {
+			case delivery, ok := <-replies:
+				if !ok {
+					return nil, fmt.Errorf("channel closed while waiting for reply")
+				} else if delivery.CorrelationId == header.CorrelationId {
+					reply := self.messageFromDelivery(channel, replyQueue.Name, delivery, true)
+
+					return reply, nil
+				}
+			case <-deadline:
+				return nil, fmt.Errorf("timed out waiting for reply to %v", header.CorrelationId)
+			}
+		}
+	} else {
+		return nil, err
+	}
+}
+
+// Receive messages from the channel.  The returned function will cancel the consumer and close
+// the channel returned by Receive().
+func (self *AMQP) Subscribe() (func() error, error) {
+	return self.SubscribeContext(context.Background())
+}
+
+// Receive messages from the channel.
+//
+// Deprecated: use Subscribe, which also returns a function that cancels the consumer.
+func (self *AMQP) SubscribeForever() error {
+	_, err := self.Subscribe()
+	return err
+}
+
+// Receive messages from the channel until the given context is cancelled or the returned function
+// is called, at which point the consumer is cancelled and the channel returned by Receive() is
+// closed.  If multiple queues are configured, a consumer is started for each of them and all
+// messages are delivered to the same channel.
+func (self *AMQP) SubscribeContext(ctx context.Context) (func() error, error) {
+	return self.subscribe(ctx, nil)
+}
+
+// Receive messages into the given channel instead of the one returned by Receive(), until the
+// returned function is called.  This allows messages from several clients to be merged into one
+// channel.  The caller owns the channel: it is never closed by the client, and the caller must
+// keep receiving from it until the returned function has been called, or delivery will stall.
+func (self *AMQP) SubscribeTo(out chan<- *Message) (func() error, error) {
+	if out == nil {
+		return nil, fmt.Errorf("no output channel given")
+	}
+
+	return self.subscribe(context.Background(), out)
+}
+
+// start consuming from all queues, delivering to the given channel.  If out is nil, messages are
+// delivered to the channel returned by Receive(), which is closed once the subscription ends.
+func (self *AMQP) subscribe(ctx context.Context, out chan<- *Message) (func() error, error) {
+	var wg sync.WaitGroup
+	var merr error
+	var errLock sync.Mutex
+
+	if _, err := self.channelReady(ctx); err != nil {
+		return nil, err
+	}
+
+	self.stateLock.Lock()
+	queues := self.queues
+
+	if self.receiving {
+		self.stateLock.Unlock()
+		return nil, fmt.Errorf("already subscribed")
+	} else if len(queues) == 0 {
+		self.stateLock.Unlock()
+		return nil, fmt.Errorf("no queues to consume from")
+	}
+
+	if err := self.compileRoutingKeyFilter(); err != nil {
+		self.stateLock.Unlock()
+		return nil, err
+	}
+
+	owned := (out == nil)
+
+	if owned {
+		// the previous subscription closed the output channel, so start a new one
+		if self.outchanClosed {
+			self.outchan = make(chan *Message)
+			self.outchanClosed = false
+		}
+
+		out = self.outchan
+	}
+
+	self.receiving = true
+	self.stateLock.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	for _, queue := range queues {
+		tag := self.ID
+
+		if len(queues) > 1 && tag != `` {
+			tag = self.ID + `-` + queue.Name
+		}
+
+		if channel, msgs, err := self.consume(ctx, queue.Name, tag); err == nil {
+			wg.Add(1)
+
+			go func(queue string, tag string) {
+				defer wg.Done()
+
+				if err := self.deliver(ctx, out, queue, tag, channel, msgs); err != nil {
+					errLock.Lock()
+					merr = utils.AppendError(merr, err)
+					errLock.Unlock()
+				}
+			}(queue.Name, tag)
+		} else {
+			cancel()
+			wg.Wait()
+			self.setReceiving(false)
+			return nil, err
+		}
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		wg.Wait()
+		cancel()
+
+		self.stateLock.Lock()
+
+		if owned {
+			close(self.outchan)
+			self.outchanClosed = true
+		}
+
+		self.receiving = false
+		self.stateLock.Unlock()
+
+		close(done)
+	}()
+
+	return func() error {
+		cancel()
+		<-done
+
+		errLock.Lock()
+		defer errLock.Unlock()
+
+		return merr
+	}, nil
+}
+
+// forward deliveries from a single consumer to the output channel until the context is cancelled
+// or the consumer goes away and cannot be reestablished.
+func (self *AMQP) deliver(ctx context.Context, out chan<- *Message, queue string, tag string, channel *amqp.Channel, msgs <-chan amqp.Delivery) error {
+	self.trackConsumer(tag, true)
+	defer self.trackConsumer(tag, false)
+
+	self.log().Debugf("consumer %q started on queue %q", tag, queue)
+	defer self.log().Debugf("consumer %q stopped", tag)
+
+	for msgs != nil {
+		select {
+		case delivery, ok := <-msgs:
+			if !ok {
+				channel, queue, msgs = self.resubscribe(ctx, queue, tag)
+				continue
+			}
+
+			message := self.messageFromDelivery(channel, queue, delivery, self.AutoAck)
+
+			if !self.accept(message) {
+				continue
+			}
+
+			select {
+			case out <- message:
+				self.countConsumed()
+				self.startAckDeadline(message)
+
+				if self.StrictOrdering {
+					select {
+					case <-message.settledchan:
+					case <-ctx.Done():
+					}
+				}
+			case <-ctx.Done():
+				// the message never reached a subscriber, so hand it back rather than leave it unacked
+				if err := message.Requeue(); err != nil {
+					self.log().Warnf("cannot requeue undelivered message %s: %v", message.ID(), err)
+				}
+			}
+		case <-ctx.Done():
+			return channel.Cancel(tag, false)
+		}
+	}
+
+	return nil
+}
+
+// compile RoutingKeyFilter for use by accept.  Must be called with stateLock held.
+func (self *AMQP) compileRoutingKeyFilter() error {
+	if self.RoutingKeyFilter != `` {
+		if rx, err := regexp.Compile(self.RoutingKeyFilter); err == nil {
+			self.routingKeyFilter = rx
+		} else {
+			return fmt.Errorf("invalid routing key filter: %v", err)
+		}
+	} else {
+		self.routingKeyFilter = nil
+	}
+
+	return nil
+}
+
+// decide whether a message should be passed along to subscribers.  Messages that are dropped are
+// acknowledged so the broker doesn't deliver them again.
+func (self *AMQP) accept(message *Message) bool {
+	self.stateLock.RLock()
+	filter := self.routingKeyFilter
+	self.stateLock.RUnlock()
+
+	if filter != nil && !filter.MatchString(message.RoutingKey) {
+		self.log().Debugf("dropping message %s: routing key %q does not match filter", message.ID(), message.RoutingKey)
+		self.drop(message)
+		return false
+	}
+
+	if dedup := self.deduplicator(); dedup != nil && message.Header.ID != `` {
+		if dedup.Seen(message.Header.ID) {
+			self.log().Debugf("dropping message %s: duplicate", message.ID())
+			self.drop(message)
+			return false
+		} else if !message.ShouldAck() {
+			// automatically acknowledged messages are never redelivered, so they count as processed
+			dedup.Remember(message.Header.ID)
+		}
+	}
+
+	return true
+}
+
+func (self *AMQP) drop(message *Message) {
+	if err := message.Acknowledge(); err != nil {
+		self.log().Warnf("cannot acknowledge dropped message %s: %v", message.ID(), err)
+	}
+}
+
+func (self *AMQP) setReceiving(receiving bool) {
+	self.stateLock.Lock()
+	defer self.stateLock.Unlock()
+
+	self.receiving = receiving
+}
+
+func (self *AMQP) isReceiving() bool {
+	self.stateLock.RLock()
+	defer self.stateLock.RUnlock()
+
+	return self.receiving
+}
+
+func (self *AMQP) trackConsumer(tag string, active bool) {
+	self.stateLock.Lock()
+	defer self.stateLock.Unlock()
+
+	if active {
+		self.consumerTags[tag] = true
+	} else {
+		delete(self.consumerTags, tag)
+	}
+}
+
+// Consume all messages currently in the queue, returning once no new message has arrived within
+// the given idle timeout.  If AutoAck is false, it is up to the caller to acknowledge the
+// returned messages.
+func (self *AMQP) Drain(timeout time.Duration) ([]*Message, error) {
+	return self.collect(func() <-chan time.Time {
+		return time.After(timeout)
+	})
+}
+
+// consume messages from the queue until the channel returned by stop fires, then stop consuming
+// and return everything that was received.  stop is called again after every message, so it can
+// either restart an idle timer or keep returning the same deadline.
+func (self *AMQP) collect(stop func() <-chan time.Time) ([]*Message, error) {
+	tag := self.generateConsumerTag()
+
+	self.stateLock.RLock()
+	queue := self.queue.Name
+	self.stateLock.RUnlock()
+
+	if channel, msgs, err := self.consume(context.Background(), queue, tag); err == nil {
+		messages := make([]*Message, 0)
+
+	Collect:
+		for {
+			select {
+			case delivery, ok := <-msgs:
+				if !ok {
+					return messages, fmt.Errorf("channel closed while receiving")
+				}
+
+				messages = append(messages, self.messageFromDelivery(channel, queue, delivery, self.AutoAck))
+			case <-stop():
+				break Collect
+			}
+		}
+
+		if err := channel.Cancel(tag, false); err != nil {
+			return messages, err
+		}
+
+		// collect anything that was delivered before the cancellation took effect
+		for delivery := range msgs {
+			messages = append(messages, self.messageFromDelivery(channel, queue, delivery, self.AutoAck))
+		}
+
+		return messages, nil
+	} else {
+		return nil, err
+	}
+}
+
+// Consume messages from the queue until the given time, regardless of how busy the queue is, then
+// stop consuming and return everything that was received (e.g.: for a job that processes whatever
+// arrives in the next minute).  If AutoAck is false, it is up to the caller to acknowledge the
+// returned messages.
+func (self *AMQP) ReceiveUntil(deadline time.Time) ([]*Message, error) {
+	remaining := time.Until(deadline)
+
+	if remaining <= 0 {
+		return nil, fmt.Errorf("deadline %v has already passed", deadline)
+	}
+
+	timer := time.NewTimer(remaining)
+	defer timer.Stop()
+
+	return self.collect(func() <-chan time.Time {
+		return timer.C
+	})
+}
+
+// Receive exactly n messages from the queue, then stop consuming.  If fewer than n messages arrive
+// before the timeout elapses (zero waits forever), the messages that did arrive are returned along
+// with ErrIncomplete.  If AutoAck is true or ack is given as true, the returned messages are
+// acknowledged; otherwise it is up to the caller to do so.  Messages the broker delivers beyond
+// the first n are returned to the queue.
+func (self *AMQP) ReceiveN(n int, timeout time.Duration, ack ...bool) ([]*Message, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("number of messages to receive must be positive")
+	}
+
+	channel, err := self.channelReady(context.Background())
+
+	if err != nil {
+		return nil, err
+	}
+
+	self.stateLock.RLock()
+	queue := self.queue.Name
+	self.stateLock.RUnlock()
+
+	tag := self.generateConsumerTag()
+	autoAck := self.AutoAck || (len(ack) > 0 && ack[0])
+
+	// always consume with manual acknowledgement, otherwise anything delivered after the nth message
+	// would be lost when we stop consuming instead of being requeued
+	args, err := self.consumerArguments(false)
+
+	if err != nil {
+		return nil, err
+	}
+
+	msgs, err := channel.Consume(queue, tag, false, self.Exclusive, self.NoLocal, false, args)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var deadline <-chan time.Time
+	var merr error
+	messages := make([]*Message, 0, n)
+	open := true
+
+	if timeout > 0 {
+		deadline = time.After(timeout)
+	}
+
+Collect:
+	for len(messages) < n {
+		select {
+		case delivery, ok := <-msgs:
+			if !ok {
+				open = false
+				merr = fmt.Errorf("channel closed while receiving")
+				break Collect
+			}
+
+			if autoAck {
+				if err := delivery.Ack(false); err != nil {
+					merr = err
+					break Collect
+				}
+			}
+
+			messages = append(messages, self.messageFromDelivery(channel, queue, delivery, autoAck))
+		case <-deadline:
+			merr = ErrIncomplete
+			break Collect
+		}
+	}
+
+	if open {
+		if err := channel.Cancel(tag, false); err != nil {
+			return messages, utils.AppendError(merr, err)
+		}
+
+		for delivery := range msgs {
+			if err := delivery.Reject(true); err != nil {
+				merr = utils.AppendError(merr, err)
+			}
+		}
+	}
+
+	return messages, merr
+}
+
+// Retrieve the next message in the queue without starting a consumer, waiting up to the given
+// timeout for one to arrive.  The message is returned to the queue unless ack is true, in which
+// case it is acknowledged (removed from the queue).  If no message is available before the timeout
+// elapses, ErrQueueEmpty is returned.
+func (self *AMQP) Peek(timeout time.Duration, ack ...bool) (*Message, error) {
+	if channel, err := self.channelReady(context.Background()); err == nil {
+		self.stateLock.RLock()
+		queue := self.queue.Name
+		self.stateLock.RUnlock()
+
+		deadline := time.Now().Add(timeout)
+
+		for {
+			if delivery, ok, err := channel.Get(queue, false); err != nil {
+				return nil, err
+			} else if ok {
+				if len(ack) > 0 && ack[0] {
+					err = delivery.Ack(false)
+				} else {
+					err = delivery.Nack(false, true)
+				}
+
+				return self.messageFromDelivery(channel, queue, delivery, true), err
+			} else if !time.Now().Before(deadline) {
+				return nil, ErrQueueEmpty
+			}
+
+			time.Sleep(50 * time.Millisecond)
+		}
+	} else {
+		return nil, err
+	}
+}
+
+// Retrieve up to limit messages from the queue (fewer if it runs out first) without removing them,
+// for auditing its contents.  Messages are fetched one at a time on a separate channel and all
+// returned to the queue once collected, so they don't need to be acknowledged.  Note that while
+// they are outstanding they are unavailable to other consumers, and once returned they are marked
+// as redelivered and may end up behind messages published in the meantime.
+func (self *AMQP) Inspect(limit int) ([]*Message, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("limit must be positive")
+	}
+
+	self.stateLock.RLock()
+	queue := self.queue.Name
+	self.stateLock.RUnlock()
+
+	channel, err := self.temporaryChannel()
+
+	if err != nil {
+		return nil, err
+	}
+
+	// anything not explicitly returned is requeued by the broker once the channel closes
+	defer channel.Close()
+
+	messages := make([]*Message, 0)
+	var last uint64
+
+	for len(messages) < limit {
+		if delivery, ok, err := channel.Get(queue, false); err != nil {
+			return messages, err
+		} else if ok {
+			last = delivery.DeliveryTag
+			messages = append(messages, self.messageFromDelivery(channel, queue, delivery, true))
+		} else {
+			break
+		}
+	}
+
+	if last > 0 {
+		if err := channel.Nack(last, true, true); err != nil {
+			return messages, err
+		}
+	}
+
+	return messages, nil
+}
+
+// build a Message from the given delivery.  If the delivery was not automatically acknowledged,
+// it will be tracked until the caller acknowledges or rejects it.
+func (self *AMQP) messageFromDelivery(channel *amqp.Channel, queue string, delivery amqp.Delivery, autoAck bool) *Message {
+	var deliveryMode DeliveryMode
+
+	switch delivery.DeliveryMode {
+	case 2:
+		deliveryMode = Persistent
+	default:
+		deliveryMode = Transient
+	}
+
+	var expiration time.Duration
+
+	// expiration is specified by the publisher in milliseconds; empty means it never expires
+	if delivery.Expiration != `` {
+		if ms, err := strconv.ParseInt(delivery.Expiration, 10, 64); err == nil && ms > 0 {
+			expiration = time.Duration(ms) * time.Millisecond
+		}
+	}
+
+	message := &Message{
+		client:        self,
+		delivery:      &delivery,
+		channel:       channel,
+		ackRequired:   !autoAck,
+		Timestamp:     delivery.Timestamp,
+		Body:          delivery.Body,
+		Queue:         queue,
+		RoutingKey:    delivery.RoutingKey,
+		Redelivered:   delivery.Redelivered,
+		DeliveryCount: deathCount(delivery.Headers),
+		Header: MessageHeader{
+			ID:              delivery.MessageId,
+			ContentType:     delivery.ContentType,
+			ContentEncoding: delivery.ContentEncoding,
+			DeliveryMode:    deliveryMode,
+			Priority:        int(delivery.Priority),
+			Expiration:      expiration,
+			CorrelationId:   delivery.CorrelationId,
+			ReplyTo:         delivery.ReplyTo,
+			AppId:           delivery.AppId,
+			UserId:          delivery.UserId,
+			Type:            delivery.Type,
+			Headers:         typeutil.MapNative(delivery.Headers),
+		},
+	}
+
+	if message.ackRequired {
+		self.trackDelivery(message)
+	}
+
+	return message
+}
+
+// Start a transaction.  Messages published (and deliveries acknowledged) after this call are held
+// by the broker until Commit is called, or discarded if Rollback is called instead.  Transactions
+// cannot be used on a connection with Confirms enabled.
+//
+// Note that once a transaction has been started the channel remains in transactional mode, so
+// messages published after a Commit or Rollback are part of the next transaction and will not be
+// delivered until the next Commit.
+func (self *AMQP) BeginTx() error {
+	if self.Confirms {
+		return fmt.Errorf("transactions cannot be used with publisher confirms")
+	}
+
+	if channel, err := self.channelReady(context.Background()); err == nil {
+		self.stateLock.Lock()
+		defer self.stateLock.Unlock()
+
+		if self.inTransaction {
+			return fmt.Errorf("a transaction is already in progress")
+		}
+
+		if err := channel.Tx(); err != nil {
+			return err
+		}
+
+		self.inTransaction = true
+		return nil
+	} else {
+		return err
+	}
+}
+
+// Commit the current transaction.
+func (self *AMQP) Commit() error {
+	return self.endTx(true)
+}
+
+// Roll back the current transaction, discarding any messages published as part of it.
+func (self *AMQP) Rollback() error {
+	return self.endTx(false)
+}
+
+func (self *AMQP) endTx(commit bool) error {
+	if channel, err := self.channelReady(context.Background()); err == nil {
+		self.stateLock.Lock()
+		defer self.stateLock.Unlock()
+
+		if !self.inTransaction {
+			return fmt.Errorf("no transaction in progress")
+		}
+
+		if commit {
+			err = channel.TxCommit()
+		} else {
+			err = channel.TxRollback()
+		}
+
+		if err == nil {
+			self.inTransaction = false
+		}
+
+		return err
+	} else {
+		return err
+	}
+}
+
+// Retrieve the current number of messages and consumers for the queue, as reported by the broker.
+func (self *AMQP) Stats() (QueueStats, error) {
+	self.stateLock.RLock()
+	name := self.queue.Name
+	self.stateLock.RUnlock()
+
+	if channel, err := self.temporaryChannel(); err == nil {
+		defer channel.Close()
+
+		if queue, err := channel.QueueDeclarePassive(name, self.Durable, self.Autodelete, self.Exclusive, false, nil); err == nil {
+			return QueueStats{
+				QueueName: queue.Name,
+				Messages:  queue.Messages,
+				Consumers: queue.Consumers,
+			}, nil
+		} else if isNotFound(err) {
+			return QueueStats{}, fmt.Errorf("queue %q does not exist", name)
+		} else {
+			return QueueStats{}, err
+		}
+	} else {
+		return QueueStats{}, err
+	}
+}
+
+// Check that the client is connected and that the broker is responding, by opening a channel and
+// (if a queue has been declared) passively declaring the queue on it.  Returns ErrNotConnected if
+// there is no connection (including while reconnecting), or ErrBrokerUnresponsive if the broker
+// doesn't answer within the timeout.
+func (self *AMQP) Ping(timeout time.Duration) error {
+	self.stateLock.RLock()
+	conn, channel, name := self.conn, self.channel, self.queue.Name
+	self.stateLock.RUnlock()
+
+	if conn == nil || channel == nil {
+		return ErrNotConnected
+	}
+
+	result := make(chan error, 1)
+
+	go func() {
+		if channel, err := conn.Channel(); err == nil {
+			defer channel.Close()
+
+			if name != `` {
+				_, err = channel.QueueDeclarePassive(name, self.Durable, self.Autodelete, self.Exclusive, false, nil)
+			}
+
+			result <- err
+		} else if err == amqp.ErrClosed {
+			result <- ErrNotConnected
+		} else {
+			result <- err
+		}
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(timeout):
+		return ErrBrokerUnresponsive
+	}
+}
+
+// Remove all messages that are ready for delivery from the queue, returning how many were removed.
+// Messages that have been delivered but not yet acknowledged are unaffected.
+func (self *AMQP) Purge() (int, error) {
+	self.stateLock.RLock()
+	name := self.queue.Name
+	self.stateLock.RUnlock()
+
+	if channel, err := self.temporaryChannel(); err == nil {
+		defer channel.Close()
+
+		if count, err := channel.QueuePurge(name, false); err == nil {
+			self.log().Infof("purged %d messages from queue %q", count, name)
+			return count, nil
+		} else if isNotFound(err) {
+			return 0, fmt.Errorf("queue %q does not exist", name)
+		} else {
+			return 0, err
+		}
+	} else {
+		return 0, err
+	}
+}
+
+// Delete the queue, returning the number of messages that were in it.  If ifUnused is true, the
+// broker refuses to delete a queue that has consumers; if ifEmpty is true, it refuses to delete a
+// queue that contains messages.  In either case, the broker's error is returned as-is.
+func (self *AMQP) DeleteQueue(ifUnused bool, ifEmpty bool) (int, error) {
+	self.stateLock.RLock()
+	name := self.queue.Name
+	self.stateLock.RUnlock()
+
+	if channel, err := self.temporaryChannel(); err == nil {
+		defer channel.Close()
+
+		if count, err := channel.QueueDelete(name, ifUnused, ifEmpty, false); err == nil {
+			self.log().Infof("deleted queue %q (%d messages)", name, count)
+			return count, nil
+		} else {
+			return 0, err
+		}
+	} else {
+		return 0, err
+	}
+}
+
+// Delete the exchange.  If ifUnused is true, the broker refuses to delete an exchange that has
+// queues bound to it, and its error is returned as-is.
+func (self *AMQP) DeleteExchange(ifUnused bool) error {
+	if self.ExchangeName == `` {
+		return fmt.Errorf("no exchange is configured")
+	}
+
+	if channel, err := self.temporaryChannel(); err == nil {
+		defer channel.Close()
+
+		if err := channel.ExchangeDelete(self.ExchangeName, ifUnused, false); err == nil {
+			self.log().Infof("deleted exchange %q", self.ExchangeName)
+			return nil
+		} else {
+			return err
+		}
+	} else {
+		return err
+	}
+}
+
+func isNotFound(err error) bool {
+	if aerr, ok := err.(*amqp.Error); ok && aerr.Code == amqp.NotFound {
+		return true
+	}
+
+	return false
+}
+
+// Receive a single message.
+func (self *AMQP) Receive() <-chan *Message {
+	self.stateLock.RLock()
+	defer self.stateLock.RUnlock()
+
+	return self.outchan
+}
+
+// A reader over the decompressed body of a received message, along with the message itself (for
+// its header, and for acknowledging it).  The reader should be closed when done.
+type MessageReader struct {
+	io.ReadCloser
+	Message *Message
+}
+
+// Receive the messages delivered by the current subscription (see Subscribe) as readers over their
+// bodies, decompressed according to their Content-Encoding, so that each one can be piped into a
+// writer without holding a decompressed copy in memory.  The underlying AMQP library always reads
+// the complete (possibly compressed) body from the broker before delivering it, so that much is
+// still buffered.  The returned channel is closed when the subscription ends.  If a body cannot be
+// decompressed, reading it returns the error.
+func (self *AMQP) ReceiveReaders() <-chan *MessageReader {
+	in := self.Receive()
+	out := make(chan *MessageReader)
+
+	go func() {
+		defer close(out)
+
+		for message := range in {
+			reader, err := message.DecompressedReader()
+
+			if err != nil {
+				reader = ioutil.NopCloser(errorReader{err})
+			}
+
+			out <- &MessageReader{
+				ReadCloser: reader,
+				Message:    message,
+			}
+		}
+	}()
+
+	return out
+}
+
+// a reader that always fails with the given error
+type errorReader struct {
+	err error
+}
+
+func (self errorReader) Read([]byte) (int, error) {
+	return 0, self.err
+}
+
+// Group the messages delivered by the current subscription (see Subscribe) into batches of up to
+// maxSize messages, emitting each batch once it is full or maxWait has elapsed since its first
+// message arrived (zero waits until it is full).  Any partial batch is emitted when the
+// subscription ends, after which the returned channel is closed.  If AutoAck is off, the caller
+// is responsible for settling the messages in each batch, e.g.: by passing the last one to
+// AckThrough.
+func (self *AMQP) ReceiveBatches(maxSize int, maxWait time.Duration) (<-chan []*Message, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("batch size must be positive")
+	} else if maxWait < 0 {
+		return nil, fmt.Errorf("batch wait must not be negative")
+	} else if !self.isReceiving() {
+		return nil, fmt.Errorf("not subscribed")
+	}
+
+	in := self.Receive()
+	out := make(chan []*Message)
+
+	go func() {
+		defer close(out)
+
+		var batch []*Message
+		var timer *time.Timer
+		var expired <-chan time.Time
+
+		flush := func() {
+			if timer != nil {
+				timer.Stop()
+				timer = nil
+				expired = nil
+			}
+
+			if len(batch) > 0 {
+				out <- batch
+				batch = nil
+			}
+		}
+
+		for {
+			select {
+			case message, ok := <-in:
+				if !ok {
+					flush()
+					return
+				}
+
+				batch = append(batch, message)
+
+				if len(batch) >= maxSize {
+					flush()
+				} else if len(batch) == 1 && maxWait > 0 {
+					timer = time.NewTimer(maxWait)
+					expired = timer.C
+				}
+			case <-expired:
+				flush()
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+// Receive a single error.
+func (self *AMQP) Err() <-chan error {
+	return self.errchan
+}
+
+// Receive a notification whenever the broker blocks or unblocks the connection.  While blocked,
+// the broker will not accept published messages, so publishers should pause until unblocked.
+func (self *AMQP) NotifyBlocked() <-chan amqp.Blocking {
+	return self.blockedchan
+}
+
+// Receive messages that were published with Mandatory set but could not be routed to any queue.
+// Each message's ReturnCode and ReturnReason describe why it was returned.  Returned messages are
+// dropped if they are not received promptly.
+func (self *AMQP) NotifyReturn() <-chan *Message {
+	return self.returnchan
+}
+
+// Receive the consumer tag of any consumer the broker cancels.  If AutoReconnect is enabled, the
+// consumer is restarted (once its queue is available again) without ending the subscription.
+func (self *AMQP) NotifyConsumerCancel() <-chan string {
+	return self.cancelchan
+}
+
+// Receive a notification whenever the connection has been automatically reestablished.
+func (self *AMQP) NotifyReconnect() <-chan struct{} {
+	return self.reconnectchan
+}
+
+// Acknowledge a message by its Delivery tag
+func (self *AMQP) Acknowledge(tag uint64) error {
+	if channel, err := self.channelReady(context.Background()); err == nil {
+		return self.settled(channel, tag, false, true, channel.Ack(tag, false))
+	} else {
+		return err
+	}
+}
+
+// Reject a message by its Delivery tag
+func (self *AMQP) Reject(tag uint64) error {
+	if channel, err := self.channelReady(context.Background()); err == nil {
+		return self.settled(channel, tag, false, false, channel.Nack(tag, false, false))
+	} else {
+		return err
+	}
+}
+
+// Requeue a message by its Delivery tag
+func (self *AMQP) Requeue(tag uint64) error {
+	if channel, err := self.channelReady(context.Background()); err == nil {
+		return self.settled(channel, tag, false, false, channel.Nack(tag, false, true))
+	} else {
+		return err
+	}
+}
+
+// Acknowledge the given message along with every unacknowledged message delivered before it, in a
+// single frame.  Delivery tags are only ordered within a channel, so this only covers messages
+// that arrived on the same channel as the given one; when consuming from several queues, or after
+// a reconnect, earlier messages from other channels must be acknowledged separately.
+func (self *AMQP) AckThrough(message *Message) error {
+	if err := self.checkSettleThrough(message); err != nil {
+		return err
+	}
+
+	return message.Acknowledge(true)
+}
+
+// Reject the given message along with every unacknowledged message delivered before it on the
+// same channel, optionally requeueing them.  The same ordering caveats as AckThrough apply.
+func (self *AMQP) RejectThrough(message *Message, requeue bool) error {
+	if err := self.checkSettleThrough(message); err != nil {
+		return err
+	}
+
+	if requeue {
+		return message.Requeue(true)
+	} else {
+		return message.Reject(true)
+	}
+}
+
+func (self *AMQP) checkSettleThrough(message *Message) error {
+	if message == nil {
+		return fmt.Errorf("no message given")
+	} else if !message.ShouldAck() {
+		return fmt.Errorf("message %s does not require acknowledgement", message.ID())
+	} else if message.client != nil && message.client != self {
+		return fmt.Errorf("message %s was not received by this client", message.ID())
+	}
+
+	return nil
+}
+
+// sum the counts of all entries in the x-death header, which the broker adds to (or updates in)
+// a message every time it is dead-lettered.
+func deathCount(headers amqp.Table) int {
+	var count int
+
+	if deaths, ok := headers[`x-death`].([]interface{}); ok {
+		for _, death := range deaths {
+			if entry, ok := death.(amqp.Table); ok {
+				count += int(typeutil.Int(entry[`count`]))
+			}
+		}
+	}
+
+	return count
+}
+
+// record the outcome of acknowledging or rejecting a delivery.
+func (self *AMQP) settled(channel *amqp.Channel, tag uint64, multiple bool, acked bool, err error) error {
+	if err != nil {
+		self.metrics().IncErrors()
+		return err
+	}
+
+	settled := self.untrackDelivery(channel, tag, multiple)
+
+	if acked {
+		self.remember(settled...)
+		self.metrics().IncAcked()
+	} else {
+		self.metrics().IncNacked()
+	}
+
+	return err
 }
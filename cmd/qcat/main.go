@@ -12,9 +12,18 @@ import (
 	"github.com/ghetzel/qcat"
 )
 
+// adapts the package-level logger for use by the AMQP client
+type clientLogger struct{}
+
+func (clientLogger) Debugf(format string, args ...interface{}) { log.Debugf(format, args...) }
+func (clientLogger) Infof(format string, args ...interface{})  { log.Infof(format, args...) }
+func (clientLogger) Warnf(format string, args ...interface{})  { log.Warningf(format, args...) }
+func (clientLogger) Errorf(format string, args ...interface{}) { log.Errorf(format, args...) }
+
 func createAmqpClient(c *cli.Context) (*qcat.AMQP, error) {
 	if len(c.Args()) > 0 {
 		if client, err := qcat.NewAMQP(c.Args()[0]); err == nil {
+			client.Logger = clientLogger{}
 			client.ConnectTimeout = c.Duration(`connect-timeout`)
 			client.Autodelete = c.Bool(`autodelete`)
 			client.Durable = c.Bool(`durable`)
@@ -23,10 +32,52 @@ func createAmqpClient(c *cli.Context) (*qcat.AMQP, error) {
 			client.Mandatory = c.Bool(`mandatory`)
 			client.ID = c.String(`consumer`)
 			client.QueueName = c.String(`queue`)
+			client.TemporaryQueue = c.Bool(`temporary-queue`)
 			client.ExchangeName = c.String(`exchange`)
+			client.ExchangeType = c.String(`exchange-type`)
+			client.ExchangeDurable = c.Bool(`exchange-durable`)
+			client.ExchangeAutodelete = c.Bool(`exchange-autodelete`)
 			client.RoutingKey = c.String(`routing-key`)
+			client.BindingKeys = c.StringSlice(`bind`)
+			client.RoutingKeyFilter = c.String(`routing-key-filter`)
+			client.StreamOffset = c.String(`stream-offset`)
 			client.Prefetch = c.Int(`prefetch`)
+			client.PrefetchBytes = c.Int(`prefetch-bytes`)
+			client.PrefetchGlobal = c.Bool(`prefetch-global`)
+			client.ConsumerPriority = c.Int(`consumer-priority`)
+			client.MaxPriority = c.Int(`max-priority`)
+			client.QueueType = c.String(`queue-type`)
+			client.SingleActiveConsumer = c.Bool(`single-active-consumer`)
+			client.NoLocal = c.Bool(`no-local`)
+			client.MaxLength = c.Int(`max-length`)
+			client.MaxLengthBytes = c.Int(`max-length-bytes`)
+			client.Overflow = c.String(`overflow`)
+			client.Lazy = c.Bool(`lazy`)
+			client.DeadLetterExchange = c.String(`dead-letter-exchange`)
+			client.DeadLetterRoutingKey = c.String(`dead-letter-routing-key`)
 			client.HeartbeatInterval = c.Duration(`heartbeat`)
+			client.AutoReconnect = c.Bool(`reconnect`)
+			client.Passive = c.Bool(`passive`)
+			client.AlternateExchange = c.String(`alternate-exchange`)
+			client.SASLMechanism = c.String(`sasl-mechanism`)
+			client.ConnectionName = c.String(`connection-name`)
+			client.TLSServerName = c.String(`tls-server-name`)
+			client.TLSInsecure = c.Bool(`tls-insecure`)
+			client.Confirms = c.Bool(`confirm`)
+			client.CompressPublish = c.Bool(`compress`)
+			client.CompressCodec = c.String(`compress-codec`)
+			client.CompressMinBytes = c.Int(`compress-min-bytes`)
+			client.MaxMessageBytes = c.Int(`max-message-bytes`)
+			client.SkipOversized = c.Bool(`skip-oversized`)
+			client.SniffContentType = c.Bool(`sniff-content-type`)
+			client.PublishRate = c.Float64(`rate`)
+			client.PublishTimeout = c.Duration(`publish-timeout`)
+
+			if c.IsSet(`tls-cert`) || c.IsSet(`tls-key`) || c.IsSet(`tls-ca`) {
+				if err := client.LoadTLSFiles(c.String(`tls-cert`), c.String(`tls-key`), c.String(`tls-ca`)); err != nil {
+					return nil, err
+				}
+			}
 
 			for _, property := range c.StringSlice(`property`) {
 				key, value := stringutil.SplitPair(property, `=`)
@@ -35,7 +86,7 @@ func createAmqpClient(c *cli.Context) (*qcat.AMQP, error) {
 
 			log.Debugf("Connecting to %s:%d vhost=%s queue=%s", client.Host, client.Port, client.Vhost, client.QueueName)
 
-			if err := client.Connect(); err == nil {
+			if err := client.ConnectRetry(c.Int(`connect-attempts`), c.Duration(`connect-backoff`)); err == nil {
 				return client, nil
 			} else {
 				return nil, fmt.Errorf("Error connecting to consumer: %v", err)
@@ -59,11 +110,43 @@ func FlagsForConsumers() []cli.Flag {
 			Usage: `The name of the queue to bind to`,
 			Value: qcat.DefaultQueueName,
 		},
+		cli.BoolFlag{
+			Name:  `temporary-queue`,
+			Usage: `Consume from a new, broker-named queue that is deleted on disconnect instead of --queue (e.g.: to tail an exchange)`,
+		},
 		cli.IntFlag{
 			Name:  `prefetch, p`,
 			Usage: `The number of items to prefetch from the queue`,
 			Value: 1,
 		},
+		cli.IntFlag{
+			Name:  `prefetch-bytes`,
+			Usage: `The maximum total size (in bytes) of unacknowledged messages to prefetch from the queue`,
+		},
+		cli.BoolFlag{
+			Name:  `prefetch-global`,
+			Usage: `Apply prefetch limits to the whole connection rather than to each consumer`,
+		},
+		cli.BoolFlag{
+			Name:  `no-local`,
+			Usage: `Don't receive messages published on the same connection (not supported by RabbitMQ)`,
+		},
+		cli.IntFlag{
+			Name:  `consumer-priority`,
+			Usage: `The priority of this consumer; the broker prefers higher-priority consumers when several are attached to the queue`,
+		},
+		cli.StringSliceFlag{
+			Name:  `bind, B`,
+			Usage: `A routing key (or pattern) used to bind the queue to the exchange; may be specified multiple times`,
+		},
+		cli.StringFlag{
+			Name:  `stream-offset`,
+			Usage: `Where to start consuming a stream queue from: first, last, next, an RFC3339 timestamp, or a numeric offset`,
+		},
+		cli.StringFlag{
+			Name:  `routing-key-filter`,
+			Usage: `Only output messages whose routing key matches this regular expression`,
+		},
 		cli.BoolFlag{
 			Name:  `raw`,
 			Usage: `Dump the whole recevied messsage.`,
@@ -73,10 +156,6 @@ func FlagsForConsumers() []cli.Flag {
 
 func FlagsForPublishers() []cli.Flag {
 	return []cli.Flag{
-		cli.StringFlag{
-			Name:  `exchange, e`,
-			Usage: `The name of the exchange to bind to`,
-		},
 		cli.StringFlag{
 			Name:  `routing-key, r`,
 			Usage: `The routing key to use when publishing messages`,
@@ -90,6 +169,14 @@ func FlagsForPublishers() []cli.Flag {
 			Name:  `content-encoding`,
 			Usage: `The Content-Encoding header to include with published messages`,
 		},
+		cli.StringFlag{
+			Name:  `app-id`,
+			Usage: `The application ID to include with published messages`,
+		},
+		cli.StringFlag{
+			Name:  `type`,
+			Usage: `The message type to include with published messages`,
+		},
 		cli.DurationFlag{
 			Name:  `ttl, t`,
 			Usage: `The maximum amount of time the message will live in a queue before being automatically deleted`,
@@ -110,6 +197,54 @@ func FlagsForPublishers() []cli.Flag {
 			Name:  `persistent, P`,
 			Usage: `Persistent messages are written to disk such that in the event of a broker crash the message is not lost`,
 		},
+		cli.BoolFlag{
+			Name:  `confirm`,
+			Usage: `Wait for the broker to confirm receipt of published messages`,
+		},
+		cli.BoolFlag{
+			Name:  `compress, z`,
+			Usage: `Compress published message bodies with gzip`,
+		},
+		cli.StringFlag{
+			Name:  `compress-codec`,
+			Usage: `Compress published message bodies with the given codec (gzip, deflate, zstd, or snappy)`,
+		},
+		cli.IntFlag{
+			Name:  `compress-min-bytes`,
+			Usage: `Don't compress message bodies smaller than this many bytes`,
+		},
+		cli.Float64Flag{
+			Name:  `rate`,
+			Usage: `The maximum number of messages to publish per second (0 is unlimited)`,
+		},
+		cli.DurationFlag{
+			Name:  `publish-timeout`,
+			Usage: `Give up publishing a message if it takes longer than this, including while the broker has blocked the connection (0 waits forever)`,
+		},
+		cli.IntFlag{
+			Name:  `max-message-bytes`,
+			Usage: `Refuse to publish lines longer than this many bytes (0 is unlimited)`,
+		},
+		cli.BoolFlag{
+			Name:  `skip-oversized`,
+			Usage: `Skip lines longer than --max-message-bytes instead of stopping with an error`,
+		},
+		cli.BoolFlag{
+			Name:  `sniff-content-type`,
+			Usage: `Set the Content-Type of messages without one to application/json, text/plain, or application/octet-stream based on their contents`,
+		},
+		cli.StringFlag{
+			Name:  `file`,
+			Usage: `Publish the contents of this file instead of reading lines from standard input`,
+		},
+		cli.IntFlag{
+			Name:  `chunk-bytes`,
+			Usage: `Split the --file into messages of at most this many bytes (0 publishes it as a single message)`,
+		},
+		cli.BoolFlag{
+			Name:  `json-lines`,
+			Usage: `Treat each line as a JSON document, rejecting lines that are not valid JSON`,
+		},
 		cli.StringSliceFlag{
 			Name:  `header, H`,
 			Usage: `A key=value pair that will be set as a message header.`,
@@ -119,6 +254,23 @@ func FlagsForPublishers() []cli.Flag {
 
 func FlagsCommon() []cli.Flag {
 	return []cli.Flag{
+		cli.StringFlag{
+			Name:  `exchange, e`,
+			Usage: `The name of the exchange to bind to`,
+		},
+		cli.StringFlag{
+			Name:  `exchange-type`,
+			Usage: `The type of exchange to declare (direct, topic, fanout, or headers)`,
+			Value: qcat.DefaultExchangeType,
+		},
+		cli.BoolFlag{
+			Name:  `exchange-durable`,
+			Usage: `Durable exchanges will survive server restarts`,
+		},
+		cli.BoolFlag{
+			Name:  `exchange-autodelete`,
+			Usage: `Auto-deleted exchanges will be automatically removed when all queues have been unbound`,
+		},
 		cli.BoolFlag{
 			Name:  `durable, D`,
 			Usage: `Durable queues will survive server restarts and remain when there are no remaining consumers or bindings`,
@@ -131,6 +283,42 @@ func FlagsCommon() []cli.Flag {
 			Name:  `exclusive, E`,
 			Usage: `Exclusive queues are only accessible by the connection that declares them and will be deleted when the connection closes`,
 		},
+		cli.StringFlag{
+			Name:  `queue-type`,
+			Usage: `The type of queue to declare: classic, quorum, or stream (quorum and stream queues require --durable)`,
+		},
+		cli.IntFlag{
+			Name:  `max-priority`,
+			Usage: `Declare the queue as a priority queue supporting priorities up to this value`,
+		},
+		cli.BoolFlag{
+			Name:  `single-active-consumer`,
+			Usage: `Declare the queue so that only one consumer at a time receives messages from it`,
+		},
+		cli.IntFlag{
+			Name:  `max-length`,
+			Usage: `Declare the queue to hold at most this many messages`,
+		},
+		cli.IntFlag{
+			Name:  `max-length-bytes`,
+			Usage: `Declare the queue to hold at most this many bytes of message bodies`,
+		},
+		cli.StringFlag{
+			Name:  `overflow`,
+			Usage: `What to do when the queue is full: drop-head, reject-publish, or reject-publish-dlx`,
+		},
+		cli.BoolFlag{
+			Name:  `lazy`,
+			Usage: `Declare the queue as lazy, keeping messages on disk instead of in memory`,
+		},
+		cli.StringFlag{
+			Name:  `dead-letter-exchange`,
+			Usage: `The exchange that rejected and expired messages will be routed to`,
+		},
+		cli.StringFlag{
+			Name:  `dead-letter-routing-key`,
+			Usage: `Replace the routing key of dead-lettered messages with this value`,
+		},
 		cli.DurationFlag{
 			Name:  `heartbeat`,
 			Usage: `Specify on what interval to send heartbeat pings.`,
@@ -144,6 +332,57 @@ func FlagsCommon() []cli.Flag {
 			Usage: `How long to wait before timing out a connection attempt.`,
 			Value: qcat.DefaultConnectTimeout,
 		},
+		cli.StringFlag{
+			Name:  `tls-cert`,
+			Usage: `A PEM-encoded client certificate to present to the broker.`,
+		},
+		cli.StringFlag{
+			Name:  `tls-key`,
+			Usage: `The PEM-encoded private key for the client certificate.`,
+		},
+		cli.StringFlag{
+			Name:  `tls-ca`,
+			Usage: `A PEM-encoded CA certificate bundle used to verify the broker (defaults to the system roots).`,
+		},
+		cli.IntFlag{
+			Name:  `connect-attempts`,
+			Usage: `How many times to try connecting to the broker before giving up (-1 retries forever).`,
+			Value: 1,
+		},
+		cli.DurationFlag{
+			Name:  `connect-backoff`,
+			Usage: `How long to wait before retrying a failed connection attempt; doubles after each failure.`,
+			Value: qcat.DefaultReconnectBackoff.Min,
+		},
+		cli.StringFlag{
+			Name:  `connection-name`,
+			Usage: `The name to identify this connection by in the broker's management interface.`,
+		},
+		cli.StringFlag{
+			Name:  `tls-server-name`,
+			Usage: `The hostname to verify the broker's TLS certificate against (defaults to the host in the URI).`,
+		},
+		cli.BoolFlag{
+			Name:  `tls-insecure`,
+			Usage: `Don't verify the broker's TLS certificate (for testing only).`,
+		},
+		cli.StringFlag{
+			Name:  `sasl-mechanism`,
+			Usage: `The SASL mechanism to authenticate with: "plain" or "external" (requires --tls-cert and --tls-key).`,
+			Value: `plain`,
+		},
+		cli.BoolFlag{
+			Name:  `reconnect`,
+			Usage: `Automatically reconnect to the broker if the connection is lost.`,
+		},
+		cli.StringFlag{
+			Name:  `alternate-exchange`,
+			Usage: `An existing exchange that unroutable messages published to the exchange are sent to.`,
+		},
+		cli.BoolFlag{
+			Name:  `passive`,
+			Usage: `Fail if the exchange or queue does not already exist instead of creating it.`,
+		},
 	}
 }
 
@@ -174,6 +413,14 @@ func headerFromContext(c *cli.Context) qcat.MessageHeader {
 		header.ContentEncoding = c.String(`content-encoding`)
 	}
 
+	if c.IsSet(`app-id`) {
+		header.AppId = c.String(`app-id`)
+	}
+
+	if c.IsSet(`type`) {
+		header.Type = c.String(`type`)
+	}
+
 	for _, pair := range c.StringSlice(`header`) {
 		if header.Headers == nil {
 			header.Headers = make(map[string]interface{})
@@ -218,7 +465,17 @@ func main() {
 				if client, err := createAmqpClient(c); err == nil {
 					header := headerFromContext(c)
 
-					if err := client.PublishLines(os.Stdin, header); err != nil {
+					var err error
+
+					if path := c.String(`file`); path != `` {
+						err = client.PublishFile(path, header, c.Int(`chunk-bytes`))
+					} else if c.Bool(`json-lines`) {
+						err = client.PublishJSONLines(os.Stdin, header)
+					} else {
+						err = client.PublishLines(os.Stdin, header)
+					}
+
+					if err != nil {
 						log.Fatalf("Error publishing: %v", err)
 					}
 				} else {
@@ -232,10 +489,14 @@ func main() {
 			ArgsUsage: `AMQP_URI`,
 			Action: func(c *cli.Context) {
 				if client, err := createAmqpClient(c); err == nil {
-					if err := client.Subscribe(); err == nil {
+					if _, err := client.Subscribe(); err == nil {
 						for {
 							select {
-							case message := <-client.Receive():
+							case message, ok := <-client.Receive():
+								if !ok {
+									return
+								}
+
 								if c.Bool(`raw`) {
 									if data, err := json.Marshal(message); err == nil {
 										fmt.Println(string(data))
@@ -263,6 +524,34 @@ func main() {
 					log.Fatalf("%v", err)
 				}
 			},
+		}, {
+			Name:  `inspect`,
+			Usage: `Connect to an AMQP message broker and print the messages in a queue as JSON, leaving them in the queue`,
+			Flags: append([]cli.Flag{
+				cli.IntFlag{
+					Name:  `limit, n`,
+					Usage: `The maximum number of messages to print`,
+					Value: 100,
+				},
+			}, append(FlagsCommon(), FlagsForConsumers()...)...),
+			ArgsUsage: `AMQP_URI`,
+			Action: func(c *cli.Context) {
+				if client, err := createAmqpClient(c); err == nil {
+					if messages, err := client.Inspect(c.Int(`limit`)); err == nil {
+						for _, message := range messages {
+							if data, err := json.Marshal(message); err == nil {
+								fmt.Println(string(data))
+							} else {
+								log.Fatalf("malformed message: %v", err)
+							}
+						}
+					} else {
+						log.Fatalf("Error inspecting queue: %v", err)
+					}
+				} else {
+					log.Fatalf("%v", err)
+				}
+			},
 		}, {
 			Name:      `serve`,
 			Usage:     `Start an HTTP server for receiving and consuming messages from an AMQP message broker`,
@@ -0,0 +1,126 @@
+package qcat
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/ghetzel/go-stockutil/utils"
+	"github.com/vmihailenco/msgpack/v5"
+	"gopkg.in/yaml.v2"
+)
+
+// EncodeFunc serializes a value into a message body.
+type EncodeFunc func(interface{}) ([]byte, error)
+
+// DecodeFunc deserializes a message body into the given value.
+type DecodeFunc func([]byte, interface{}) error
+
+type codec struct {
+	encode EncodeFunc
+	decode DecodeFunc
+}
+
+var codecs = make(map[string]codec)
+var codecsLock sync.RWMutex
+
+func init() {
+	RegisterCodec(`application/json`, json.Marshal, json.Unmarshal)
+	RegisterCodec(`application/msgpack`, msgpack.Marshal, msgpack.Unmarshal)
+	RegisterCodec(`application/x-msgpack`, msgpack.Marshal, msgpack.Unmarshal)
+	RegisterCodec(`application/yaml`, yaml.Marshal, yaml.Unmarshal)
+	RegisterCodec(`application/x-yaml`, yaml.Marshal, yaml.Unmarshal)
+}
+
+// Register the functions used to encode (in PublishEncoded) and decode (in Message.Decode) message
+// bodies with the given Content-Type, replacing any that were registered before.  Either function
+// may be nil if only one direction is supported.  Media type parameters (e.g.: "; charset=utf-8")
+// are ignored when looking up a codec.
+func RegisterCodec(contentType string, enc EncodeFunc, dec DecodeFunc) {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+
+	codecs[normalizeContentType(contentType)] = codec{
+		encode: enc,
+		decode: dec,
+	}
+}
+
+func codecFor(contentType string) (codec, bool) {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+
+	c, ok := codecs[normalizeContentType(contentType)]
+	return c, ok
+}
+
+// guess the content type of a message body.
+func sniffContentType(data []byte) string {
+	if json.Valid(data) {
+		return `application/json`
+	} else if utf8.Valid(data) {
+		return `text/plain`
+	}
+
+	return `application/octet-stream`
+}
+
+func normalizeContentType(contentType string) string {
+	if mediatype, _, err := mime.ParseMediaType(contentType); err == nil {
+		return mediatype
+	}
+
+	return strings.ToLower(strings.TrimSpace(contentType))
+}
+
+// Publish a value, encoded with the codec registered for the header's ContentType (which defaults
+// to application/json).  As with Message.Decode, content types with no registered encoder fall
+// back to publishing []byte and string values as-is.
+func (self *AMQP) PublishEncoded(value interface{}, header MessageHeader) error {
+	if header.ContentType == `` {
+		header.ContentType = `application/json`
+	}
+
+	if c, ok := codecFor(header.ContentType); ok && c.encode != nil {
+		if data, err := c.encode(value); err == nil {
+			return self.Publish(data, header)
+		} else {
+			return fmt.Errorf("serialization error: %v", err)
+		}
+	} else if data, ok := value.([]byte); ok {
+		return self.Publish(data, header)
+	} else if str, ok := value.(string); ok {
+		return self.Publish([]byte(str), header)
+	} else {
+		return fmt.Errorf("no encoder registered for content type %q, and a %T cannot be published as-is", header.ContentType, value)
+	}
+}
+
+// Decode every message received (see Receive) into a value returned by calling factory, and send
+// the value to out, until the subscription ends.  Since the values passed along can't be used to
+// settle the message they came from, each message is acknowledged once its value has been sent.
+// If a message can't be decoded, it is rejected and the error returned.  The out channel is not
+// closed.
+func (self *AMQP) DecodeEach(factory func() interface{}, out chan<- interface{}) error {
+	for message := range self.Receive() {
+		value := factory()
+
+		if err := message.Decode(value); err != nil {
+			return utils.AppendError(
+				fmt.Errorf("cannot decode message %s: %v", message.ID(), err),
+				message.Reject(),
+			)
+		}
+
+		out <- value
+
+		if err := message.Acknowledge(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,115 @@
+package qcat
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// compress data using the compression scheme named by a Content-Encoding value.
+func compress(encoding string, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var writer io.WriteCloser
+
+	switch normalizeEncoding(encoding) {
+	case `gzip`:
+		writer = gzip.NewWriter(&buf)
+	case `deflate`:
+		writer = zlib.NewWriter(&buf)
+	case `zstd`:
+		if w, err := zstd.NewWriter(&buf); err == nil {
+			writer = w
+		} else {
+			return nil, err
+		}
+	case `snappy`:
+		return snappy.Encode(nil, data), nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// decompress data according to the given Content-Encoding value.  Bodies with no (or an
+// unrecognized) encoding are returned as-is.
+func decompress(encoding string, data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return data, nil
+	}
+
+	if reader, err := decompressReader(encoding, bytes.NewReader(data)); err == nil {
+		defer reader.Close()
+
+		if out, err := ioutil.ReadAll(reader); err == nil {
+			return out, nil
+		} else {
+			return nil, fmt.Errorf("cannot decompress %s body: %v", encoding, err)
+		}
+	} else {
+		return nil, err
+	}
+}
+
+// wrap the given reader so that reading from it yields data decompressed according to the given
+// Content-Encoding value.  Data with no (or an unrecognized) encoding is passed through as-is.
+func decompressReader(encoding string, r io.Reader) (io.ReadCloser, error) {
+	var reader io.ReadCloser
+	var err error
+
+	switch normalizeEncoding(encoding) {
+	case `gzip`:
+		reader, err = gzip.NewReader(r)
+	case `deflate`:
+		reader, err = zlib.NewReader(r)
+	case `zstd`:
+		var zd *zstd.Decoder
+
+		if zd, err = zstd.NewReader(r); err == nil {
+			reader = zd.IOReadCloser()
+		}
+	case `snappy`:
+		// snappy's block format can only be decoded all at once
+		var data, out []byte
+
+		if data, err = ioutil.ReadAll(r); err == nil {
+			if out, err = snappy.Decode(nil, data); err == nil {
+				reader = ioutil.NopCloser(bytes.NewReader(out))
+			}
+		}
+	default:
+		return ioutil.NopCloser(r), nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot decompress %s body: %v", encoding, err)
+	}
+
+	return reader, nil
+}
+
+func normalizeEncoding(encoding string) string {
+	switch encoding = strings.ToLower(strings.TrimSpace(encoding)); encoding {
+	case `x-gzip`:
+		return `gzip`
+	case `x-snappy`:
+		return `snappy`
+	default:
+		return encoding
+	}
+}
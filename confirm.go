@@ -0,0 +1,146 @@
+package qcat
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ghetzel/go-stockutil/utils"
+	"github.com/streadway/amqp"
+)
+
+// Tracks the delivery tags assigned to messages published on a channel in confirm mode, and
+// routes the broker's acknowledgements back to whoever is waiting on them.  Messages published
+// without waiting are tracked until they are confirmed, so that flush can wait for them all.
+type confirmTracker struct {
+	nextTag uint64
+	waiters map[uint64]chan bool
+	async   map[uint64]bool
+	nacked  []uint64
+	lost    []uint64
+	closed  bool
+	lock    sync.Mutex
+}
+
+func newConfirmTracker(confirmations <-chan amqp.Confirmation) *confirmTracker {
+	tracker := &confirmTracker{
+		nextTag: 1,
+		waiters: make(map[uint64]chan bool),
+		async:   make(map[uint64]bool),
+	}
+
+	go tracker.run(confirmations)
+
+	return tracker
+}
+
+func (self *confirmTracker) run(confirmations <-chan amqp.Confirmation) {
+	for confirmation := range confirmations {
+		self.lock.Lock()
+
+		if waiter, ok := self.waiters[confirmation.DeliveryTag]; ok {
+			delete(self.waiters, confirmation.DeliveryTag)
+			waiter <- confirmation.Ack
+		} else if self.async[confirmation.DeliveryTag] {
+			delete(self.async, confirmation.DeliveryTag)
+
+			if !confirmation.Ack {
+				self.nacked = append(self.nacked, confirmation.DeliveryTag)
+			}
+		}
+
+		self.lock.Unlock()
+	}
+
+	// the channel closed; anyone still waiting will never hear back
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for tag, waiter := range self.waiters {
+		close(waiter)
+		delete(self.waiters, tag)
+	}
+
+	for tag := range self.async {
+		self.lost = append(self.lost, tag)
+		delete(self.async, tag)
+	}
+
+	self.closed = true
+}
+
+// Perform a publish and assign it the next delivery tag.  If wait is true, the returned channel
+// will receive true if the broker acknowledges the message, false if it is rejected, and will
+// be closed if the channel goes away before either happens.
+func (self *confirmTracker) publish(publishFn func() error, wait bool) (uint64, <-chan bool, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.closed {
+		return 0, nil, fmt.Errorf("channel closed")
+	}
+
+	if err := publishFn(); err != nil {
+		return 0, nil, err
+	}
+
+	tag := self.nextTag
+	self.nextTag += 1
+
+	if wait {
+		waiter := make(chan bool, 1)
+		self.waiters[tag] = waiter
+
+		return tag, waiter, nil
+	}
+
+	self.async[tag] = true
+
+	return tag, nil, nil
+}
+
+// wait for every message published without waiting to be confirmed, returning an error listing
+// any that the broker rejected or that were lost when the channel closed.
+func (self *confirmTracker) flush(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		self.lock.Lock()
+		pending := len(self.async)
+
+		if pending == 0 {
+			nacked, lost := self.nacked, self.lost
+			self.nacked, self.lost = nil, nil
+			self.lock.Unlock()
+
+			var merr error
+
+			if len(nacked) > 0 {
+				merr = utils.AppendError(merr, fmt.Errorf("broker rejected messages %v", sortedTags(nacked)))
+			}
+
+			if len(lost) > 0 {
+				merr = utils.AppendError(merr, fmt.Errorf("channel closed before messages %v were confirmed", sortedTags(lost)))
+			}
+
+			return merr
+		}
+
+		self.lock.Unlock()
+
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("timed out waiting for %d messages to be confirmed", pending)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func sortedTags(tags []uint64) []uint64 {
+	sort.Slice(tags, func(i, j int) bool {
+		return tags[i] < tags[j]
+	})
+
+	return tags
+}
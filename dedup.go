@@ -0,0 +1,84 @@
+package qcat
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Deduplicator remembers the IDs of messages that have been acknowledged, so that later copies of
+// the same message can be detected.  Implementations must be safe for concurrent use, and may be
+// backed by shared storage (e.g.: Redis) so that several consumers can deduplicate together.
+type Deduplicator interface {
+	// Return whether the given message ID has been recorded.
+	Seen(id string) bool
+
+	// Record the given message ID, once the message it belongs to has been acknowledged.
+	Remember(id string)
+}
+
+// An in-memory Deduplicator that remembers the most recent IDs, up to a fixed number.
+type LRUDeduplicator struct {
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+	lock    sync.Mutex
+}
+
+// Create a Deduplicator that remembers the given number of most recently seen message IDs.
+func NewLRUDeduplicator(size int) *LRUDeduplicator {
+	return &LRUDeduplicator{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (self *LRUDeduplicator) Seen(id string) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	_, ok := self.entries[id]
+	return ok
+}
+
+func (self *LRUDeduplicator) Remember(id string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if el, ok := self.entries[id]; ok {
+		self.order.MoveToFront(el)
+		return
+	}
+
+	self.entries[id] = self.order.PushFront(id)
+
+	for self.order.Len() > self.size {
+		oldest := self.order.Back()
+		self.order.Remove(oldest)
+		delete(self.entries, oldest.Value.(string))
+	}
+}
+
+// record the IDs of acknowledged messages with the deduplicator, if there is one.
+func (self *AMQP) remember(messages ...*Message) {
+	if dedup := self.deduplicator(); dedup != nil {
+		for _, message := range messages {
+			if message.Header.ID != `` {
+				dedup.Remember(message.Header.ID)
+			}
+		}
+	}
+}
+
+// the deduplicator to use for this client, creating the default one on first use if DedupWindow
+// is set.
+func (self *AMQP) deduplicator() Deduplicator {
+	self.stateLock.Lock()
+	defer self.stateLock.Unlock()
+
+	if self.Dedup == nil && self.DedupWindow > 0 {
+		self.Dedup = NewLRUDeduplicator(self.DedupWindow)
+	}
+
+	return self.Dedup
+}
@@ -0,0 +1,121 @@
+package qcat
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// Headers set on messages published by PublishFile.  FileNameHeader holds the base name of the
+// file; when a file is split into chunks, FilePartHeader holds the (1-based) number of the part
+// and FilePartsHeader holds the total number of parts, so that consumers can reassemble it.
+var (
+	FileNameHeader  = `x-filename`
+	FilePartHeader  = `x-file-part`
+	FilePartsHeader = `x-file-parts`
+)
+
+// Publish the contents of the file at the given path.  If chunkBytes is zero, the whole file is
+// published as a single message, and it is an error for the file to be larger than
+// MaxMessageBytes.  Otherwise, the file is split into sequential messages of up to chunkBytes
+// each.  The ContentType defaults to one guessed from the file's extension or, failing that, its
+// contents.
+func (self *AMQP) PublishFile(path string, header MessageHeader, chunkBytes int) error {
+	if chunkBytes < 0 {
+		return fmt.Errorf("chunk size must not be negative, got %d", chunkBytes)
+	} else if self.MaxMessageBytes > 0 && chunkBytes > self.MaxMessageBytes {
+		return fmt.Errorf("chunk size of %d bytes exceeds the maximum of %d", chunkBytes, self.MaxMessageBytes)
+	}
+
+	file, err := os.Open(path)
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	stat, err := file.Stat()
+
+	if err != nil {
+		return err
+	} else if stat.IsDir() {
+		return fmt.Errorf("%s is a directory", path)
+	}
+
+	size := stat.Size()
+
+	if chunkBytes == 0 {
+		if self.MaxMessageBytes > 0 && size > int64(self.MaxMessageBytes) {
+			return fmt.Errorf("%s is %d bytes, exceeding the maximum of %d", path, size, self.MaxMessageBytes)
+		}
+
+		chunkBytes = int(size)
+	}
+
+	parts := 1
+
+	if size > 0 && chunkBytes > 0 {
+		parts = int((size + int64(chunkBytes) - 1) / int64(chunkBytes))
+	}
+
+	buf := make([]byte, chunkBytes)
+
+	for part := 1; part <= parts; part++ {
+		n, err := io.ReadFull(file, buf)
+
+		if err == io.ErrUnexpectedEOF || (err == io.EOF && size == 0) {
+			err = nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("cannot read part %d of %s: %v", part, path, err)
+		}
+
+		if header.ContentType == `` {
+			header.ContentType = sniffFileType(path, buf[:n])
+		}
+
+		if err := self.Publish(buf[:n], fileHeader(header, filepath.Base(path), part, parts)); err != nil {
+			if parts > 1 {
+				return fmt.Errorf("cannot publish part %d of %d: %v", part, parts, err)
+			} else {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// copy the header, adding the details that identify files and the parts of chunked files.
+func fileHeader(header MessageHeader, name string, part int, parts int) MessageHeader {
+	headers := make(map[string]interface{}, len(header.Headers)+3)
+
+	for k, v := range header.Headers {
+		headers[k] = v
+	}
+
+	headers[FileNameHeader] = name
+
+	if parts > 1 {
+		headers[FilePartHeader] = part
+		headers[FilePartsHeader] = parts
+	}
+
+	header.Headers = headers
+
+	return header
+}
+
+// guess the content type from a file's extension, falling back to sniffing its first bytes.
+func sniffFileType(path string, data []byte) string {
+	if kind := mime.TypeByExtension(filepath.Ext(path)); kind != `` {
+		return kind
+	}
+
+	return http.DetectContentType(data)
+}
@@ -1,11 +1,16 @@
 module github.com/ghetzel/qcat
 
 require (
+	github.com/eknkc/amber v0.0.0-20171010120322-cdade1c07385 // indirect
 	github.com/ghetzel/cli v1.17.0
 	github.com/ghetzel/go-stockutil v1.8.93
+	github.com/golang/snappy v1.0.0
 	github.com/julienschmidt/httprouter v0.0.0-20180715161854-348b672cd90d
+	github.com/klauspost/compress v1.15.15
 	github.com/streadway/amqp v0.0.0-20180806233856-70e15c650864
+	github.com/vmihailenco/msgpack/v5 v5.3.5
 	gopkg.in/unrolled/render.v1 v1.0.0-20180914162206-b9786414de4d
+	gopkg.in/yaml.v2 v2.4.0
 )
 
 go 1.12
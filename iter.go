@@ -0,0 +1,38 @@
+//go:build go1.23
+// +build go1.23
+
+package qcat
+
+import (
+	"iter"
+)
+
+// Return an iterator over the messages received by the client's subscriptions, for use with
+// range-over-func:
+//
+//	for msg, err := range client.Messages() {
+//		...
+//	}
+//
+// Iteration ends once the subscription stops delivering messages or the connection closes; in the
+// latter case the final iteration yields the error describing why.  Breaking out of the loop does
+// not stop the subscription.
+func (self *AMQP) Messages() iter.Seq2[*Message, error] {
+	return func(yield func(*Message, error) bool) {
+		out := self.Receive()
+
+		for {
+			select {
+			case msg, ok := <-out:
+				if !ok {
+					return
+				} else if !yield(msg, nil) {
+					return
+				}
+			case err := <-self.Err():
+				yield(nil, err)
+				return
+			}
+		}
+	}
+}
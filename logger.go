@@ -0,0 +1,54 @@
+package qcat
+
+import (
+	"fmt"
+)
+
+// Logger receives messages about connection and consumer lifecycle events.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// NoopLogger discards everything it is given.
+type NoopLogger struct{}
+
+func (NoopLogger) Debugf(format string, args ...interface{}) {}
+func (NoopLogger) Infof(format string, args ...interface{})  {}
+func (NoopLogger) Warnf(format string, args ...interface{})  {}
+func (NoopLogger) Errorf(format string, args ...interface{}) {}
+
+// prefixes every message with details identifying the connection it came from
+type contextLogger struct {
+	logger Logger
+	prefix string
+}
+
+func (self contextLogger) Debugf(format string, args ...interface{}) {
+	self.logger.Debugf(self.prefix+format, args...)
+}
+
+func (self contextLogger) Infof(format string, args ...interface{}) {
+	self.logger.Infof(self.prefix+format, args...)
+}
+
+func (self contextLogger) Warnf(format string, args ...interface{}) {
+	self.logger.Warnf(self.prefix+format, args...)
+}
+
+func (self contextLogger) Errorf(format string, args ...interface{}) {
+	self.logger.Errorf(self.prefix+format, args...)
+}
+
+func (self *AMQP) log() Logger {
+	if self.Logger == nil {
+		return NoopLogger{}
+	}
+
+	return contextLogger{
+		logger: self.Logger,
+		prefix: fmt.Sprintf("[id=%s vhost=%s] ", self.ID, self.Vhost),
+	}
+}
@@ -0,0 +1,177 @@
+package qcat
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ghetzel/go-stockutil/sliceutil"
+)
+
+// The port the RabbitMQ management plugin listens on by default.
+var DefaultManagementPort = 15672
+
+// A binding between an exchange and a queue, as reported by the RabbitMQ management API.
+type Binding struct {
+	Exchange   string                 `json:"source"`
+	Queue      string                 `json:"destination"`
+	RoutingKey string                 `json:"routing_key"`
+	Arguments  map[string]interface{} `json:"arguments"`
+}
+
+// Detailed statistics about a queue, as reported by the RabbitMQ management API.
+type MgmtQueueStats struct {
+	Name                   string       `json:"name"`
+	Vhost                  string       `json:"vhost"`
+	State                  string       `json:"state"`
+	Messages               int          `json:"messages"`
+	MessagesReady          int          `json:"messages_ready"`
+	MessagesUnacknowledged int          `json:"messages_unacknowledged"`
+	Consumers              int          `json:"consumers"`
+	ConsumerUtilisation    float64      `json:"consumer_utilisation"` // the fraction of time the queue could deliver to consumers immediately
+	Memory                 int64        `json:"memory"`               // bytes of memory used by the queue
+	MessageStats           MgmtMsgStats `json:"message_stats"`
+}
+
+// Counts (since the queue was created) and recent rates (per second) of messages passing through
+// a queue.
+type MgmtMsgStats struct {
+	Publish          int64    `json:"publish"`
+	PublishDetails   MgmtRate `json:"publish_details"`
+	Deliver          int64    `json:"deliver_get"`
+	DeliverDetails   MgmtRate `json:"deliver_get_details"`
+	Ack              int64    `json:"ack"`
+	AckDetails       MgmtRate `json:"ack_details"`
+	Redeliver        int64    `json:"redeliver"`
+	RedeliverDetails MgmtRate `json:"redeliver_details"`
+}
+
+type MgmtRate struct {
+	Rate float64 `json:"rate"`
+}
+
+// Retrieve detailed statistics for the declared queue from the RabbitMQ management API, including
+// message rates, consumer utilisation, and memory use, none of which are available over AMQP.
+func (self *AMQP) ManagementStats() (*MgmtQueueStats, error) {
+	self.stateLock.RLock()
+	name := self.queue.Name
+	self.stateLock.RUnlock()
+
+	if name == `` {
+		return nil, fmt.Errorf("no queue has been declared")
+	}
+
+	var stats MgmtQueueStats
+
+	if err := self.management(self.queuePath(name), &stats); err == nil {
+		return &stats, nil
+	} else {
+		return nil, err
+	}
+}
+
+// Retrieve the bindings of the declared queue, including the implicit binding to the default
+// exchange (which has an empty Exchange name).  The AMQP protocol has no way to list bindings, so
+// this queries the RabbitMQ management API at ManagementURL using the client's credentials, and
+// fails if the management plugin is not enabled or reachable.
+func (self *AMQP) Bindings() ([]Binding, error) {
+	self.stateLock.RLock()
+	name := self.queue.Name
+	self.stateLock.RUnlock()
+
+	if name == `` {
+		return nil, fmt.Errorf("no queue has been declared")
+	}
+
+	var bindings []Binding
+
+	if err := self.management(self.queuePath(name)+`/bindings`, &bindings); err == nil {
+		return bindings, nil
+	} else {
+		return nil, err
+	}
+}
+
+func (self *AMQP) queuePath(name string) string {
+	return `/api/queues/` + url.PathEscape(self.VirtualHost()) + `/` + url.PathEscape(name)
+}
+
+// the base URL of the management API, defaulting to the broker's host on the management port.
+func (self *AMQP) managementURL() string {
+	if self.ManagementURL != `` {
+		return strings.TrimSuffix(self.ManagementURL, `/`)
+	}
+
+	scheme := `http`
+	port := self.ManagementPort
+
+	if self.ManagementTLS != nil {
+		scheme = `https`
+	}
+
+	if port <= 0 {
+		port = DefaultManagementPort
+	}
+
+	return fmt.Sprintf("%s://%s:%d", scheme, self.Host, port)
+}
+
+// retrieve the given management API path, decoding the JSON response into out.
+func (self *AMQP) management(path string, out interface{}) error {
+	base := self.managementURL()
+	req, err := http.NewRequest(`GET`, base+path, nil)
+
+	if err != nil {
+		return fmt.Errorf("invalid management URL %q: %v", base, err)
+	}
+
+	if self.ManagementUsername != `` {
+		req.SetBasicAuth(self.ManagementUsername, self.ManagementPassword)
+	} else {
+		req.SetBasicAuth(self.Username, self.Password)
+	}
+	req.Header.Set(`Accept`, `application/json`)
+
+	client := &http.Client{
+		Timeout: self.ConnectTimeout,
+	}
+
+	if self.ManagementTLS != nil {
+		client.Transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: self.ManagementTLS,
+		}
+	}
+
+	if client.Timeout <= 0 {
+		client.Timeout = 10 * time.Second
+	}
+
+	res, err := client.Do(req)
+
+	if err != nil {
+		return fmt.Errorf("management API is not available at %s (is the management plugin enabled?): %v", base, err)
+	}
+
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusUnauthorized:
+		return fmt.Errorf("management API at %s refused the credentials for user %q", base, sliceutil.OrString(self.ManagementUsername, self.Username))
+	case res.StatusCode == http.StatusNotFound:
+		return fmt.Errorf("management API at %s has no resource %s", base, path)
+	case res.StatusCode >= 400:
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("management API at %s returned %s: %s", base, res.Status, strings.TrimSpace(string(body)))
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		return fmt.Errorf("invalid response from management API at %s: %v", base, err)
+	}
+
+	return nil
+}
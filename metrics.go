@@ -0,0 +1,62 @@
+package qcat
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Metrics receives notifications about client activity so that it can be exported to a monitoring
+// system (e.g.: a Prometheus collector) without this package depending on one directly.
+// Implementations must be safe for concurrent use.
+type Metrics interface {
+	IncPublished()
+	IncConsumed()
+	IncAcked()
+	IncNacked()
+	IncErrors()
+	ObservePublishLatency(time.Duration)
+}
+
+// NoopMetrics discards everything it is given.
+type NoopMetrics struct{}
+
+func (NoopMetrics) IncPublished()                       {}
+func (NoopMetrics) IncConsumed()                        {}
+func (NoopMetrics) IncAcked()                           {}
+func (NoopMetrics) IncNacked()                          {}
+func (NoopMetrics) IncErrors()                          {}
+func (NoopMetrics) ObservePublishLatency(time.Duration) {}
+
+// Return the number of messages this client has published.
+func (self *AMQP) Published() uint64 {
+	return atomic.LoadUint64(&self.published)
+}
+
+// Return the number of messages this client's subscriptions have delivered.
+func (self *AMQP) Consumed() uint64 {
+	return atomic.LoadUint64(&self.consumed)
+}
+
+// Reset the Published and Consumed counts to zero.
+func (self *AMQP) ResetCounters() {
+	atomic.StoreUint64(&self.published, 0)
+	atomic.StoreUint64(&self.consumed, 0)
+}
+
+func (self *AMQP) countPublished() {
+	atomic.AddUint64(&self.published, 1)
+	self.metrics().IncPublished()
+}
+
+func (self *AMQP) countConsumed() {
+	atomic.AddUint64(&self.consumed, 1)
+	self.metrics().IncConsumed()
+}
+
+func (self *AMQP) metrics() Metrics {
+	if self.Metrics != nil {
+		return self.Metrics
+	} else {
+		return NoopMetrics{}
+	}
+}
@@ -0,0 +1,336 @@
+package qcat
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/ghetzel/go-stockutil/utils"
+	"github.com/streadway/amqp"
+)
+
+// A Publisher publishes messages on its own channel, separate from the one the client uses, so
+// that publishing can't be held up by (or hold up) consumers on the same connection.  Messages are
+// published to the client's ExchangeName with its RoutingKey, using its Confirms, PublishTimeout,
+// Mandatory, and compression settings, and returned messages are sent to the client's NotifyReturn.  PublishRate limits the client and all of its Publishers together.
+type Publisher struct {
+	client     *AMQP
+	channel    *amqp.Channel
+	confirms   *confirmTracker
+	flowPaused chan struct{}
+	closed     bool
+	lock       sync.Mutex
+}
+
+// A Consumer receives messages from the client's queue on its own channel, with its own prefetch
+// limits, separate from the one the client uses for publishing.
+type Consumer struct {
+	// The number of unacknowledged messages the broker will deliver to this consumer before
+	// waiting for acknowledgements, overriding the client's Prefetch so that fast and slow
+	// consumers on the same connection can be tuned separately.  Zero uses the client's Prefetch.
+	// Must be set before calling Subscribe.
+	Prefetch int
+
+	client  *AMQP
+	channel *amqp.Channel
+	tag     string
+	done    chan struct{}
+	lock    sync.Mutex
+}
+
+// Return a Publisher that publishes on its own channel.  The channel is opened when the first
+// message is published, and reopened as needed if it (or the connection) goes away.
+func (self *AMQP) Publisher() *Publisher {
+	return &Publisher{
+		client: self,
+	}
+}
+
+// Return a Consumer that consumes on its own channel.
+func (self *AMQP) Consumer() *Consumer {
+	return &Consumer{
+		client: self,
+	}
+}
+
+// Publish a single message.  If the client has Confirms enabled, this waits for the broker to
+// confirm it.
+func (self *Publisher) Publish(data []byte, header MessageHeader) error {
+	return self.PublishContext(context.Background(), data, header)
+}
+
+// Publish a single message, giving up if the context is cancelled before it can be sent.
+func (self *Publisher) PublishContext(ctx context.Context, data []byte, header MessageHeader) error {
+	client := self.client
+	msg, err := client.publishing(data, header)
+
+	if err != nil {
+		return err
+	}
+
+	tag, ack, err := client.publishVia(ctx, self.open, self.waitFlow, client.ExchangeName, client.RoutingKey, msg, true)
+
+	if err == nil && ack != nil {
+		err = client.waitConfirm(ctx, tag, ack)
+	}
+
+	return err
+}
+
+// wait for the broker to resume flow on the publisher's channel, if it is paused.
+func (self *Publisher) waitFlow(ctx context.Context) error {
+	self.lock.Lock()
+	paused := self.flowPaused
+	self.lock.Unlock()
+
+	if paused != nil {
+		select {
+		case <-paused:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// record whether the broker wants publishing to be active.  Must be called with lock held.
+func (self *Publisher) setFlow(active bool) {
+	if !active && self.flowPaused == nil {
+		self.flowPaused = make(chan struct{})
+	} else if active && self.flowPaused != nil {
+		close(self.flowPaused)
+		self.flowPaused = nil
+	}
+}
+
+// Close the publisher's channel.
+func (self *Publisher) Close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.closed = true
+
+	if self.channel != nil {
+		channel := self.channel
+		self.channel = nil
+		self.confirms = nil
+
+		return channel.Close()
+	}
+
+	return nil
+}
+
+// return the publisher's channel, opening it if it's not already open.
+func (self *Publisher) open(ctx context.Context) (*amqp.Channel, *confirmTracker, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.closed {
+		return nil, nil, fmt.Errorf("publisher is closed")
+	} else if self.channel != nil {
+		return self.channel, self.confirms, nil
+	}
+
+	channel, err := self.client.openChannel(ctx)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var confirms *confirmTracker
+
+	if self.client.Confirms {
+		if err := channel.Confirm(false); err == nil {
+			confirms = newConfirmTracker(channel.NotifyPublish(make(chan amqp.Confirmation, 64)))
+		} else {
+			channel.Close()
+			return nil, nil, err
+		}
+	}
+
+	// unroutable messages come back on this channel, not the client's, so pass them along too
+	go self.client.watchReturns(channel)
+
+	// hold publishes while the broker has paused flow on the channel
+	go func() {
+		for active := range channel.NotifyFlow(make(chan bool, 1)) {
+			self.lock.Lock()
+			self.setFlow(active)
+			self.lock.Unlock()
+
+			if active {
+				self.client.log().Infof("flow resumed by broker on publisher channel")
+			} else {
+				self.client.log().Warnf("flow paused by broker on publisher channel")
+			}
+		}
+
+		// the channel is gone, so release anyone waiting on it; the next publish opens a new one
+		self.lock.Lock()
+		self.setFlow(true)
+		self.lock.Unlock()
+	}()
+
+	// forget the channel once it closes so that the next publish opens a new one
+	go func() {
+		for range channel.NotifyClose(make(chan *amqp.Error, 1)) {
+		}
+
+		self.lock.Lock()
+		defer self.lock.Unlock()
+
+		if self.channel == channel {
+			self.channel = nil
+			self.confirms = nil
+		}
+	}()
+
+	self.channel = channel
+	self.confirms = confirms
+
+	return channel, confirms, nil
+}
+
+// Start consuming from the client's queue, returning a channel that receives messages until Close
+// is called or the consumer's channel goes away (e.g.: because the connection was lost), at which
+// point it is closed.  Unlike the client's own subscriptions, consumers are not restarted
+// automatically after a reconnect; call Subscribe again to resume.
+func (self *Consumer) Subscribe() (<-chan *Message, error) {
+	client := self.client
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.channel != nil {
+		return nil, fmt.Errorf("already subscribed")
+	} else if self.Prefetch < 0 {
+		return nil, fmt.Errorf("prefetch must not be negative, got %d", self.Prefetch)
+	}
+
+	args, err := client.consumerArguments(client.AutoAck)
+
+	if err != nil {
+		return nil, err
+	}
+
+	client.stateLock.Lock()
+	err = client.compileRoutingKeyFilter()
+	client.stateLock.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	channel, err := client.openChannel(context.Background())
+
+	if err != nil {
+		return nil, err
+	}
+
+	prefetch := client.prefetch()
+
+	if self.Prefetch > 0 {
+		prefetch = self.Prefetch
+	}
+
+	if err := channel.Qos(prefetch, client.PrefetchBytes, client.PrefetchGlobal); err != nil {
+		channel.Close()
+		return nil, err
+	}
+
+	client.stateLock.RLock()
+	queue := client.queue.Name
+	client.stateLock.RUnlock()
+
+	tag := client.generateConsumerTag()
+	msgs, err := channel.Consume(queue, tag, client.AutoAck, client.Exclusive, client.NoLocal, false, args)
+
+	if err != nil {
+		channel.Close()
+		return nil, err
+	}
+
+	out := make(chan *Message)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(out)
+		defer client.untrackChannel(channel)
+
+		// forget the channel once deliveries stop so that Subscribe can be called again
+		defer func() {
+			self.lock.Lock()
+			defer self.lock.Unlock()
+
+			if self.channel == channel {
+				channel.Close()
+				self.channel = nil
+				self.tag = ``
+				self.done = nil
+			}
+		}()
+
+		for delivery := range msgs {
+			message := client.messageFromDelivery(channel, queue, delivery, client.AutoAck)
+
+			if !client.accept(message) {
+				continue
+			}
+
+			select {
+			case out <- message:
+				client.countConsumed()
+			case <-done:
+				// anything left unacknowledged is redelivered once the channel closes
+				return
+			}
+		}
+	}()
+
+	self.channel = channel
+	self.tag = tag
+	self.done = done
+
+	return out, nil
+}
+
+// Cancel the consumer and close its channel.
+func (self *Consumer) Close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	var merr error
+
+	if self.channel != nil {
+		close(self.done)
+
+		if err := self.channel.Cancel(self.tag, false); err != nil {
+			merr = utils.AppendError(merr, err)
+		}
+
+		if err := self.channel.Close(); err != nil {
+			merr = utils.AppendError(merr, err)
+		}
+
+		self.channel = nil
+		self.tag = ``
+		self.done = nil
+	}
+
+	return merr
+}
+
+// open a new channel on the current connection, waiting for any in-progress reconnect first.
+func (self *AMQP) openChannel(ctx context.Context) (*amqp.Channel, error) {
+	if _, err := self.channelReady(ctx); err != nil {
+		return nil, err
+	}
+
+	self.stateLock.RLock()
+	conn := self.conn
+	self.stateLock.RUnlock()
+
+	return conn.Channel()
+}
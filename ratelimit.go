@@ -0,0 +1,51 @@
+package qcat
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// A token bucket that paces callers to a fixed number of operations per second.  Each call to
+// wait reserves a token, sleeping for however long it takes for that token to become available.
+type rateLimiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+	lock   sync.Mutex
+}
+
+func (self *rateLimiter) wait(ctx context.Context, rate float64) error {
+	self.lock.Lock()
+
+	now := time.Now()
+
+	if self.rate != rate || self.last.IsZero() {
+		self.rate = rate
+		self.tokens = 1
+	} else {
+		self.tokens += now.Sub(self.last).Seconds() * self.rate
+	}
+
+	// allow at most one message's worth of burst so publishing is evenly paced
+	if self.tokens > 1 {
+		self.tokens = 1
+	}
+
+	self.last = now
+	self.tokens -= 1
+	delay := time.Duration(-self.tokens / self.rate * float64(time.Second))
+
+	self.lock.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -10,6 +10,8 @@ import (
 
 	"github.com/ghetzel/go-stockutil/httputil"
 	"github.com/ghetzel/go-stockutil/log"
+	"github.com/ghetzel/go-stockutil/stringutil"
+	"github.com/ghetzel/go-stockutil/typeutil"
 	"github.com/julienschmidt/httprouter"
 	"gopkg.in/unrolled/render.v1"
 )
@@ -89,6 +91,22 @@ func (self *HttpServer) loadRoutes() {
 			header.DeliveryMode = Transient
 		}
 
+		if pairs := req.URL.Query()[`header`]; len(pairs) > 0 {
+			headers := make(map[string]interface{})
+
+			for k, v := range self.BaseHeader.Headers {
+				headers[k] = v
+			}
+
+			for _, pair := range pairs {
+				if k, v := stringutil.SplitPair(pair, `=`); v != `` {
+					headers[k] = typeutil.Auto(v)
+				}
+			}
+
+			header.Headers = headers
+		}
+
 		if httputil.QBool(req, `lines`) {
 			if err := self.amqp.PublishLines(req.Body, header); err != nil {
 				self.Respond(w, http.StatusServiceUnavailable, nil, fmt.Errorf("Error publishing: %v", err))
@@ -0,0 +1,119 @@
+package qcat
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/streadway/amqp"
+)
+
+// Load a client certificate and key (for mutual TLS) and a CA certificate bundle used to verify
+// the broker, storing the resulting configuration in TLS.  If caFile is empty, the system's root
+// CAs are used.  If certFile and keyFile are empty, no client certificate is presented and only
+// the server is authenticated.
+func (self *AMQP) LoadTLSFiles(certFile, keyFile, caFile string) error {
+	var config *tls.Config
+
+	// the ServerName is left for the library to fill in from the host being dialed
+	if self.TLS != nil {
+		config = self.TLS.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+
+	if certFile != `` || keyFile != `` {
+		if certFile == `` || keyFile == `` {
+			return fmt.Errorf("both a certificate and key file must be specified for client authentication")
+		}
+
+		if cert, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+			config.Certificates = []tls.Certificate{cert}
+		} else {
+			return fmt.Errorf("cannot load client certificate: %v", err)
+		}
+	}
+
+	if caFile != `` {
+		if pem, err := ioutil.ReadFile(caFile); err == nil {
+			pool := x509.NewCertPool()
+
+			if !pool.AppendCertsFromPEM(pem) {
+				return fmt.Errorf("no certificates found in %s", caFile)
+			}
+
+			config.RootCAs = pool
+		} else {
+			return fmt.Errorf("cannot load CA certificates: %v", err)
+		}
+	}
+
+	self.TLS = config
+
+	return nil
+}
+
+// the TLS configuration to connect with.  A copy is returned since the library fills in the
+// ServerName of the configuration it is given (from the host being dialed) if it is empty.
+func (self *AMQP) tlsConfig() (*tls.Config, error) {
+	if self.TLSServerName == `` && !self.TLSInsecure {
+		if self.TLS != nil {
+			return self.TLS.Clone(), nil
+		}
+
+		return nil, nil
+	} else if self.connectionURI().Scheme != `amqps` {
+		return nil, fmt.Errorf("TLSServerName and TLSInsecure require an amqps:// URI")
+	}
+
+	var config *tls.Config
+
+	if self.TLS != nil {
+		config = self.TLS.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+
+	if self.TLSServerName != `` {
+		config.ServerName = self.TLSServerName
+	}
+
+	if self.TLSInsecure {
+		self.log().Warnf("TLS certificate verification is disabled; the connection is not protected against impersonation")
+		config.InsecureSkipVerify = true
+	}
+
+	return config, nil
+}
+
+// authenticates using the identity from the client's TLS certificate
+type externalAuth struct{}
+
+func (externalAuth) Mechanism() string {
+	return `EXTERNAL`
+}
+
+func (externalAuth) Response() string {
+	return ``
+}
+
+// the SASL mechanisms to offer the broker; nil means the library default of PLAIN using the
+// credentials from the URI.
+func (self *AMQP) sasl() ([]amqp.Authentication, error) {
+	switch strings.ToLower(self.SASLMechanism) {
+	case ``, `plain`:
+		return nil, nil
+	case `external`:
+		if self.connectionURI().Scheme != `amqps` {
+			return nil, fmt.Errorf("EXTERNAL authentication requires an amqps:// URI")
+		} else if self.TLS == nil || (len(self.TLS.Certificates) == 0 && self.TLS.GetClientCertificate == nil) {
+			return nil, fmt.Errorf("EXTERNAL authentication requires a TLS client certificate")
+		}
+
+		return []amqp.Authentication{externalAuth{}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported SASL mechanism %q", self.SASLMechanism)
+	}
+}
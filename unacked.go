@@ -0,0 +1,113 @@
+package qcat
+
+import (
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Delivery tags are only unique within the channel they were delivered on, so outstanding
+// deliveries are tracked by both.
+type deliveryKey struct {
+	channel *amqp.Channel
+	tag     uint64
+}
+
+// record that a message has been delivered to the caller and must be acknowledged or rejected.
+func (self *AMQP) trackDelivery(message *Message) {
+	self.unackedLock.Lock()
+	defer self.unackedLock.Unlock()
+
+	if self.unacked == nil {
+		self.unacked = make(map[deliveryKey]*Message)
+	}
+
+	message.settledchan = make(chan struct{})
+	self.unacked[deliveryKey{message.channel, message.DeliveryTag()}] = message
+}
+
+// record that the given delivery (and, if multiple is true, all deliveries before it on the
+// same channel) have been acknowledged or rejected, returning the messages that were settled.
+func (self *AMQP) untrackDelivery(channel *amqp.Channel, tag uint64, multiple bool) []*Message {
+	self.unackedLock.Lock()
+	defer self.unackedLock.Unlock()
+
+	var settled []*Message
+
+	if multiple {
+		for key, message := range self.unacked {
+			if key.channel == channel && key.tag <= tag {
+				settled = append(settled, message)
+				self.forget(key)
+			}
+		}
+	} else if message, ok := self.unacked[deliveryKey{channel, tag}]; ok {
+		settled = append(settled, message)
+		self.forget(deliveryKey{channel, tag})
+	}
+
+	return settled
+}
+
+// forget about all deliveries made on the given channel; used when the channel goes away, since
+// the broker will redeliver anything that was not acknowledged.
+func (self *AMQP) untrackChannel(channel *amqp.Channel) {
+	self.unackedLock.Lock()
+	defer self.unackedLock.Unlock()
+
+	for key := range self.unacked {
+		if key.channel == channel {
+			self.forget(key)
+		}
+	}
+}
+
+// Return the number of messages that have been delivered but not yet acknowledged or rejected.
+func (self *AMQP) Unacked() int {
+	self.unackedLock.Lock()
+	defer self.unackedLock.Unlock()
+
+	return len(self.unacked)
+}
+
+// untrack a single delivery, returning false if it was not being tracked (because it has already
+// been settled, or its channel has gone away).
+func (self *AMQP) claimDelivery(channel *amqp.Channel, tag uint64) bool {
+	self.unackedLock.Lock()
+	defer self.unackedLock.Unlock()
+
+	key := deliveryKey{channel, tag}
+
+	if _, ok := self.unacked[key]; ok {
+		self.forget(key)
+		return true
+	}
+
+	return false
+}
+
+// stop tracking a delivery, waking anything waiting for it to be settled.  The caller must hold
+// unackedLock.
+func (self *AMQP) forget(key deliveryKey) {
+	if message, ok := self.unacked[key]; ok {
+		delete(self.unacked, key)
+		close(message.settledchan)
+	}
+}
+
+// requeue the given message if it is still outstanding once AckDeadline elapses.
+func (self *AMQP) startAckDeadline(message *Message) {
+	if self.AckDeadline <= 0 || !message.ShouldAck() {
+		return
+	}
+
+	deadline := self.AckDeadline
+
+	time.AfterFunc(deadline, func() {
+		if err := message.Requeue(); err == nil {
+			self.log().Warnf("message %s was not acknowledged within %v, requeued", message.ID(), deadline)
+		} else if err != ErrAlreadySettled {
+			self.log().Warnf("cannot requeue message %s after ack deadline: %v", message.ID(), err)
+		}
+	})
+}